@@ -13,42 +13,48 @@ import (
 
 var f *os.File
 
-type MyCallback struct {}
-
-func (cb *MyCallback) OnData(dType int, data interface{}) {
-	if dType == spytypes.SamplesComplex64 {
-		samples := data.([]complex64)
-		log.Println("Received Complex 64 bit Data! ", len(samples))
-	} else if dType == spytypes.SamplesComplex32 {
-		samples := data.([]spytypes.ComplexInt16)
-		log.Println("Received Complex 32 bit Data! ", len(samples))
-		buf := new(bytes.Buffer)
-		binary.Write(buf, binary.LittleEndian, data)
-
-		f.Write(buf.Bytes())
-	} else if dType == spytypes.SamplesComplexUInt8 {
-		samples := data.([]spytypes.ComplexUInt8)
-		log.Println("Received Complex 64 Data! ", len(samples))
-	} else if dType == spytypes.FFTUInt8 {
-		samples := data.([]complex64)
-		log.Println("Received FFT Data! ", len(samples))
-	} else if dType == spytypes.DeviceSync {
-		log.Println("Got device sync!")
-	}
+func onInt16IQ(samples []spytypes.ComplexInt16) {
+	log.Println("Received Complex 32 bit Data! ", len(samples))
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, samples)
+
+	f.Write(buf.Bytes())
+}
+
+func onFFT(bins []uint8) {
+	log.Println("Received FFT Data! ", len(bins))
 }
 
 func main() {
 	var ss = spyserver.MakeSpyserver("127.0.0.1", 5555)
 
-	var cb = MyCallback{}
+	var handler = spytypes.Handler{
+		OnInt16IQ: onInt16IQ,
+		OnFFT:     onFFT,
+		OnDeviceSync: func() {
+			log.Println("Got device sync!")
+		},
+		OnError: func(err error) {
+			log.Println("Connection error: ", err)
+		},
+		OnReconnecting: func(info spytypes.ReconnectInfo) {
+			log.Printf("Connection lost (%s), reconnect attempt %d\n", info.Err, info.Attempt)
+		},
+		OnReconnected: func(info spytypes.ReconnectInfo) {
+			log.Println("Reconnected!")
+		},
+	}
 
 	if f == nil {
 		f, _ = os.Create("iq.raw")
 	}
 
-	ss.SetCallback(&cb)
+	ss.SetHandler(handler)
+	ss.SetReconnectPolicy(&spyserver.DefaultReconnectPolicy)
 
-	ss.Connect()
+	if err := ss.Connect(); err != nil {
+		log.Fatalf("Error connecting to spyserver: %s\n", err)
+	}
 
 	log.Println(fmt.Sprintf("Device: %s", ss.GetName()))
 	var srs = ss.GetAvailableSampleRates()
@@ -57,11 +63,11 @@ func main() {
 	for i := 0; i < len(srs); i++ {
 		log.Println(fmt.Sprintf("		%f msps", float32(srs[i]) / 1e6))
 	}
-	if ss.SetSampleRate(625000) == spyserver.InvalidValue {
-		log.Println("Error setting sample rate.")
+	if err := ss.SetSampleRate(625000); err != nil {
+		log.Println("Error setting sample rate: ", err)
 	}
-	if ss.SetCenterFrequency(106300000) == spyserver.InvalidValue {
-		log.Println("Error setting center frequency.")
+	if err := ss.SetCenterFrequency(106300000); err != nil {
+		log.Println("Error setting center frequency: ", err)
 	}
 
 	ss.SetStreamingMode(spyserver.StreamModeIQOnly)
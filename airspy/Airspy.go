@@ -6,6 +6,8 @@ import (
 	"github.com/racerxdl/spy2go/spytypes"
 	"github.com/racerxdl/spy2go/spywrap"
 	"log"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -53,7 +55,18 @@ type Device struct {
 	lnaGain uint8
 	vgaGain uint8
 	mixGain uint8
-	cb      spytypes.Callback
+
+	// mtx guards the fields used by the native callback thread
+	mtx        sync.Mutex
+	handler    spytypes.Handler
+	iqChannels []*spytypes.FrameChannel[spytypes.SampleBlock]
+
+	// droppedSamples is the number of samples lost by libairspy since the device was opened
+	droppedSamples uint64
+
+	// Only touched by the native callback thread while streaming
+	transferCount uint32
+	sampleIndex   uint64
 }
 
 func MakeAirspyDevice(serial uint64) *Device {
@@ -137,6 +150,7 @@ func MakeAirspyDevice(serial uint64) *Device {
 }
 
 func (f *Device) Close() {
+	f.closeChannels()
 	spywrap.Airspy_close(f.instance)
 }
 
@@ -157,16 +171,34 @@ func (f *Device) GetAvailableSampleRates() []uint32 {
 	return f.sampleRates
 }
 func (f *Device) GetCenterFrequency() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.centerFrequency
 }
 func (f *Device) GetSampleRate() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.sampleRate
 }
+
+// GetDroppedSamples returns how many samples libairspy dropped since the device was opened.
+func (f *Device) GetDroppedSamples() uint64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.droppedSamples
+}
+
+// IsStreaming returns true if the device is streaming.
+func (f *Device) IsStreaming() bool {
+	return spywrap.Airspy_is_streaming(f.instance) == spywrap.AirspyTrue
+}
 func (f *Device) SetSampleRate(sampleRate uint32) *Device {
 	if f.sampleRate != sampleRate {
 
 		if spywrap.Airspy_is_streaming(f.instance) == spywrap.AirspyTrue {
-			return f.Stop().SetSampleRate(sampleRate).Start()
+			// Restarts without closing the channels
+			f.stopRx()
+			return f.SetSampleRate(sampleRate).Start()
 		}
 
 		r := spywrap.Airspy_set_samplerate(f.instance, uint(sampleRate))
@@ -174,7 +206,9 @@ func (f *Device) SetSampleRate(sampleRate uint32) *Device {
 			panic(spywrap.GetAirspyError(r))
 		}
 
+		f.mtx.Lock()
 		f.sampleRate = sampleRate
+		f.mtx.Unlock()
 	}
 	return f
 }
@@ -192,11 +226,15 @@ func (f *Device) SetCenterFrequency(centerFrequency uint32) *Device {
 		if r != spywrap.AirspySuccess {
 			panic(spywrap.GetAirspyError(r))
 		}
+		f.mtx.Lock()
 		f.centerFrequency = centerFrequency
+		f.mtx.Unlock()
 	}
 	return f
 }
 func (f *Device) Start() *Device {
+	f.transferCount = 0
+	f.sampleIndex = 0
 
 	cb := spywrap.Callback{
 		Func: internalCallback,
@@ -211,10 +249,15 @@ func (f *Device) Start() *Device {
 	return f
 }
 func (f *Device) Stop() *Device {
+	// Unblocks the callback if it is waiting on a channel with OverflowBlock
+	f.closeChannels()
+	f.stopRx()
+	return f
+}
+func (f *Device) stopRx() {
 	if spywrap.Airspy_is_streaming(f.instance) == spywrap.AirspyTrue {
 		spywrap.Airspy_stop_rx(f.instance)
 	}
-	return f
 }
 func (f *Device) SetAGC(agc bool) *Device {
 
@@ -284,11 +327,85 @@ func (f *Device) SetSampleType(sampleType int) *Device {
 	return f
 }
 
-func (f *Device) SetCallback(cb spytypes.Callback) *Device {
-	f.cb = cb
+// SetHandler sets the handler functions for the device samples
+func (f *Device) SetHandler(h spytypes.Handler) *Device {
+	f.mtx.Lock()
+	f.handler = h
+	f.mtx.Unlock()
 	return f
 }
 
+// SetCallback sets the legacy callback for the device samples. It is the same as SetHandler(spytypes.CallbackHandler(cb)).
+//
+// Deprecated: use SetHandler.
+func (f *Device) SetCallback(cb spytypes.Callback) *Device {
+	return f.SetHandler(spytypes.CallbackHandler(cb))
+}
+
+// IQChannel returns a channel that receives the IQ samples, buffering up to bufferDepth blocks.
+// The policy defines what happens when the buffer is full. OverflowBlock stalls the native callback thread.
+// The channel is closed by Stop or Close, after which a new one must be requested.
+// With OverflowBlock, changing the sample rate while streaming waits for the consumer to receive the pending block.
+func (f *Device) IQChannel(bufferDepth int, policy spytypes.OverflowPolicy) <-chan spytypes.SampleBlock {
+	var c = spytypes.NewFrameChannel[spytypes.SampleBlock](bufferDepth, policy)
+	f.mtx.Lock()
+	f.iqChannels = append(f.iqChannels, c)
+	f.mtx.Unlock()
+	return c.C()
+}
+
+// sampleBlock returns a SampleBlock with the current device parameters and advances the sample index.
+// droppedSamples is the number of samples lost by libairspy before this transfer.
+func (f *Device) sampleBlock(sampleCount int, droppedSamples uint64) spytypes.SampleBlock {
+	f.mtx.Lock()
+	f.droppedSamples += droppedSamples
+	var block = spytypes.SampleBlock{
+		SequenceNumber:  f.transferCount,
+		CenterFrequency: f.centerFrequency,
+		SampleRate:      f.sampleRate,
+		Timestamp:       time.Now(),
+		SampleIndex:     f.sampleIndex,
+	}
+	f.mtx.Unlock()
+
+	f.transferCount++
+	f.sampleIndex += uint64(sampleCount)
+
+	return block
+}
+
+func (f *Device) getHandler() spytypes.Handler {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.handler
+}
+
+func (f *Device) getIQChannels() []*spytypes.FrameChannel[spytypes.SampleBlock] {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.iqChannels
+}
+
+func (f *Device) closeChannels() {
+	f.mtx.Lock()
+	var iqChannels = f.iqChannels
+	f.iqChannels = nil
+	f.mtx.Unlock()
+
+	for _, c := range iqChannels {
+		c.Close()
+	}
+}
+
+func deliverIQ(h spytypes.Handler, channels []*spytypes.FrameChannel[spytypes.SampleBlock], block spytypes.SampleBlock) {
+	if h.OnSampleBlock != nil {
+		h.OnSampleBlock(block)
+	}
+	for _, c := range channels {
+		c.Send(block)
+	}
+}
+
 func internalCallback(data interface{}, transfer spywrap.Airspy_transfer_t) int {
 	f := data.(*Device)
 	const arrLen = 1 << 20
@@ -296,55 +413,64 @@ func internalCallback(data interface{}, transfer spywrap.Airspy_transfer_t) int
 	var samples = transfer.GetSamples()
 	var length = transfer.GetSample_count()
 
-	if f.cb != nil {
-		var arr interface{}
-		var stype int
-		switch sampleType {
-		case spywrap.AirspySampleFloat32Iq:
+	var h = f.getHandler()
+	var iqChannels = f.getIQChannels()
+	var block = f.sampleBlock(int(length), transfer.GetDropped_samples())
+
+	switch sampleType {
+	case spywrap.AirspySampleFloat32Iq:
+		if h.OnFloatIQ != nil || h.OnSampleBlock != nil || len(iqChannels) > 0 {
 			vArr := (*[arrLen]complex64)(unsafe.Pointer(samples))[:length:length]
 			tmpArr := make([]complex64, length)
 			copy(tmpArr, vArr)
-			arr = tmpArr
-			stype = spytypes.SamplesComplex64
-			break
-		case spywrap.AirspySampleFloat32Real:
+			if h.OnFloatIQ != nil {
+				h.OnFloatIQ(tmpArr)
+			}
+			block.Complex64 = tmpArr
+			deliverIQ(h, iqChannels, block)
+		}
+	case spywrap.AirspySampleFloat32Real:
+		if h.OnFloatReal != nil {
 			vArr := (*[arrLen]float32)(unsafe.Pointer(samples))[:length:length]
 			tmpArr := make([]float32, length)
 			copy(tmpArr, vArr)
-			arr = tmpArr
-			stype = spytypes.SamplesFloat32
-			break
-		case spywrap.AirspySampleInt16Iq:
+			h.OnFloatReal(tmpArr)
+		}
+	case spywrap.AirspySampleInt16Iq:
+		if h.OnInt16IQ != nil || h.OnSampleBlock != nil || len(iqChannels) > 0 {
 			vArr := (*[arrLen]spytypes.ComplexInt16)(unsafe.Pointer(samples))[:length:length]
 			tmpArr := make([]spytypes.ComplexInt16, length)
 			copy(tmpArr, vArr)
-			arr = tmpArr
-			stype = spytypes.SamplesComplex32
-		case spywrap.AirspySampleInt16Real:
+			if h.OnInt16IQ != nil {
+				h.OnInt16IQ(tmpArr)
+			}
+			block.ComplexInt16 = tmpArr
+			deliverIQ(h, iqChannels, block)
+		}
+	case spywrap.AirspySampleInt16Real:
+		if h.OnInt16Real != nil {
 			vArr := (*[arrLen]int16)(unsafe.Pointer(samples))[:length:length]
 			tmpArr := make([]int16, length)
 			copy(tmpArr, vArr)
-			arr = tmpArr
-			stype = spytypes.SamplesInt16
-			break
-		case spywrap.AirspySampleUint16Real:
+			h.OnInt16Real(tmpArr)
+		}
+	case spywrap.AirspySampleUint16Real:
+		if h.OnUInt16Real != nil {
 			vArr := (*[arrLen]uint16)(unsafe.Pointer(samples))[:length:length]
 			tmpArr := make([]uint16, length)
 			copy(tmpArr, vArr)
-			arr = tmpArr
-			stype = spytypes.SamplesUInt16
-		case spywrap.AirspySampleRaw:
+			h.OnUInt16Real(tmpArr)
+		}
+	case spywrap.AirspySampleRaw:
+		if h.OnRaw != nil {
 			vArr := (*[arrLen]byte)(unsafe.Pointer(samples))[:length:length]
 			tmpArr := make([]byte, length)
 			copy(tmpArr, vArr)
-			arr = tmpArr
-			stype = spytypes.SamplesBytes
-		default:
-			log.Printf("Unknown sample type received!!!!")
-			return 1
+			h.OnRaw(tmpArr)
 		}
-
-		f.cb.OnData(stype, arr)
+	default:
+		log.Printf("Unknown sample type received!!!!")
+		return 1
 	}
 	return 0
 }
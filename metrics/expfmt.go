@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// metricType is the TYPE of a metric family in the text format
+type metricType string
+
+const (
+	gauge   metricType = "gauge"
+	counter metricType = "counter"
+)
+
+// sample is one line of a metric family
+type sample struct {
+	labels [][2]string
+	value  float64
+}
+
+// family is a metric with all its samples, written in the Prometheus text format
+type family struct {
+	name    string
+	help    string
+	kind    metricType
+	samples []sample
+}
+
+// families keeps the metric families in the order they were first added
+type families struct {
+	order  []*family
+	byName map[string]*family
+}
+
+func newFamilies() *families {
+	return &families{byName: map[string]*family{}}
+}
+
+// add appends a sample to the family, creating it if needed.
+// labels are name and value pairs.
+func (fs *families) add(name, help string, kind metricType, value float64, labels ...string) {
+	var f = fs.byName[name]
+	if f == nil {
+		f = &family{name: name, help: help, kind: kind}
+		fs.byName[name] = f
+		fs.order = append(fs.order, f)
+	}
+
+	var s = sample{value: value}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.labels = append(s.labels, [2]string{labels[i], labels[i+1]})
+	}
+	f.samples = append(f.samples, s)
+}
+
+// write writes all families in the Prometheus text format, version 0.0.4
+func (fs *families) write(w io.Writer) error {
+	var b strings.Builder
+
+	for _, f := range fs.order {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.samples {
+			b.WriteString(f.name)
+			if len(s.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", l[0], escapeLabel(l[1]))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(formatValue(s.value))
+			b.WriteByte('\n')
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
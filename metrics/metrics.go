@@ -0,0 +1,168 @@
+// Package metrics exports the state and counters of spyserver and airspy sources
+// in the Prometheus text format, through a standard /metrics HTTP handler.
+//
+// It doesn't depend on the Prometheus client library. The sources are used through
+// interfaces, so this package doesn't need cgo and libairspy unless an airspy.Device is added.
+//
+//	var exporter = metrics.NewExporter()
+//	exporter.AddSpyserver("rooftop", client)
+//	http.Handle("/metrics", exporter)
+package metrics
+
+import (
+	"github.com/racerxdl/spy2go/spyserver"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// SpyserverSource is the part of *spyserver.Spyserver used by the Exporter.
+type SpyserverSource interface {
+	IsConnected() bool
+	IsStreaming() bool
+	TotalStats() spyserver.Stats
+	Latency() spyserver.LatencyStats
+	Reconnects() uint64
+	GetCenterFrequency() uint32
+	GetSampleRate() uint32
+	GetGain() uint32
+}
+
+// AirspySource is the part of *airspy.Device used by the Exporter.
+type AirspySource interface {
+	IsStreaming() bool
+	GetCenterFrequency() uint32
+	GetSampleRate() uint32
+	GetDroppedSamples() uint64
+}
+
+var _ SpyserverSource = (*spyserver.Spyserver)(nil)
+
+// Exporter collects the metrics of all its sources on each request.
+// Each source is identified by the receiver label. It is safe for concurrent use.
+type Exporter struct {
+	mtx        sync.Mutex
+	spyservers map[string]SpyserverSource
+	airspys    map[string]AirspySource
+}
+
+// NewExporter creates an Exporter without sources.
+func NewExporter() *Exporter {
+	return &Exporter{
+		spyservers: map[string]SpyserverSource{},
+		airspys:    map[string]AirspySource{},
+	}
+}
+
+// AddSpyserver adds a spyserver client, replacing any source with the same name.
+func (e *Exporter) AddSpyserver(name string, s SpyserverSource) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	delete(e.airspys, name)
+	e.spyservers[name] = s
+}
+
+// AddAirspy adds an airspy device, replacing any source with the same name.
+func (e *Exporter) AddAirspy(name string, d AirspySource) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	delete(e.spyservers, name)
+	e.airspys[name] = d
+}
+
+// Remove removes the source with the given name.
+func (e *Exporter) Remove(name string) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	delete(e.spyservers, name)
+	delete(e.airspys, name)
+}
+
+// ServeHTTP writes the metrics of all sources in the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.collect().write(w)
+}
+
+// collect reads the metrics of all sources, sorted by name
+func (e *Exporter) collect() *families {
+	e.mtx.Lock()
+	var spyservers = make(map[string]SpyserverSource, len(e.spyservers))
+	for name, s := range e.spyservers {
+		spyservers[name] = s
+	}
+	var airspys = make(map[string]AirspySource, len(e.airspys))
+	for name, d := range e.airspys {
+		airspys[name] = d
+	}
+	e.mtx.Unlock()
+
+	var fs = newFamilies()
+	for _, name := range sortedKeys(spyservers) {
+		collectSpyserver(fs, name, spyservers[name])
+	}
+	for _, name := range sortedKeys(airspys) {
+		collectAirspy(fs, name, airspys[name])
+	}
+
+	return fs
+}
+
+func collectSpyserver(fs *families, name string, s SpyserverSource) {
+	var stats = s.TotalStats()
+	var latency = s.Latency()
+
+	fs.add("spy2go_spyserver_connected", "Whether the client is connected to the server.", gauge, boolValue(s.IsConnected()), "receiver", name)
+	fs.add("spy2go_spyserver_streaming", "Whether the streaming is enabled.", gauge, boolValue(s.IsStreaming()), "receiver", name)
+	fs.add("spy2go_spyserver_reconnects_total", "Connections restored by the reconnect policy.", counter, float64(s.Reconnects()), "receiver", name)
+	fs.add("spy2go_spyserver_received_bytes_total", "Bytes received.", counter, float64(stats.Bytes), "receiver", name)
+	fs.add("spy2go_spyserver_received_bytes_per_second", "Bytes received per second over the last few seconds.", gauge, stats.Throughput, "receiver", name)
+	fs.add("spy2go_spyserver_decode_errors_total", "Messages that couldn't be decoded.", counter, float64(stats.DecodeErrors), "receiver", name)
+	fs.add("spy2go_spyserver_unsupported_messages_total", "Messages of a type the client doesn't handle.", counter, float64(stats.UnsupportedMessages), "receiver", name)
+
+	for _, stream := range []struct {
+		name  string
+		stats spyserver.StreamStats
+	}{{"iq", stats.IQ}, {"af", stats.AF}, {"fft", stats.FFT}} {
+		fs.add("spy2go_spyserver_stream_frames_total", "Messages received per stream.", counter, float64(stream.stats.Frames), "receiver", name, "stream", stream.name)
+		fs.add("spy2go_spyserver_stream_frames_per_second", "Messages received per second and stream over the last few seconds.", gauge, stream.stats.FrameRate, "receiver", name, "stream", stream.name)
+		fs.add("spy2go_spyserver_stream_bytes_total", "Bytes received per stream.", counter, float64(stream.stats.Bytes), "receiver", name, "stream", stream.name)
+		fs.add("spy2go_spyserver_stream_bytes_per_second", "Bytes received per second and stream over the last few seconds.", gauge, stream.stats.Throughput, "receiver", name, "stream", stream.name)
+		fs.add("spy2go_spyserver_stream_dropped_frames_total", "Messages missing from the sequence numbers.", counter, float64(stream.stats.DroppedFrames), "receiver", name, "stream", stream.name)
+		fs.add("spy2go_spyserver_stream_gaps_total", "Times the sequence numbers skipped messages.", counter, float64(stream.stats.Gaps), "receiver", name, "stream", stream.name)
+		fs.add("spy2go_spyserver_stream_channel_drops_total", "Frames discarded by the overflow policy of the channels.", counter, float64(stream.stats.ChannelDrops), "receiver", name, "stream", stream.name)
+	}
+
+	fs.add("spy2go_spyserver_ping_latency_seconds", "Round trip time of the last keepalive ping.", gauge, latency.Last.Seconds(), "receiver", name)
+	fs.add("spy2go_spyserver_ping_latency_average_seconds", "Average round trip time of the keepalive pings.", gauge, latency.Avg.Seconds(), "receiver", name)
+	fs.add("spy2go_spyserver_ping_latency_min_seconds", "Minimum round trip time of the keepalive pings.", gauge, latency.Min.Seconds(), "receiver", name)
+	fs.add("spy2go_spyserver_ping_latency_max_seconds", "Maximum round trip time of the keepalive pings.", gauge, latency.Max.Seconds(), "receiver", name)
+	fs.add("spy2go_spyserver_pongs_total", "Keepalive pongs received.", counter, float64(stats.Pongs), "receiver", name)
+
+	fs.add("spy2go_spyserver_center_frequency_hertz", "Center frequency of the IQ channel.", gauge, float64(s.GetCenterFrequency()), "receiver", name)
+	fs.add("spy2go_spyserver_sample_rate_hertz", "Sample rate of the IQ channel.", gauge, float64(s.GetSampleRate()), "receiver", name)
+	fs.add("spy2go_spyserver_gain_index", "Gain stage index.", gauge, float64(s.GetGain()), "receiver", name)
+}
+
+func collectAirspy(fs *families, name string, d AirspySource) {
+	fs.add("spy2go_airspy_streaming", "Whether the device is streaming.", gauge, boolValue(d.IsStreaming()), "receiver", name)
+	fs.add("spy2go_airspy_dropped_samples_total", "Samples dropped by libairspy.", counter, float64(d.GetDroppedSamples()), "receiver", name)
+	fs.add("spy2go_airspy_center_frequency_hertz", "Center frequency of the device.", gauge, float64(d.GetCenterFrequency()), "receiver", name)
+	fs.add("spy2go_airspy_sample_rate_hertz", "Sample rate of the device.", gauge, float64(d.GetSampleRate()), "receiver", name)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	var keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"github.com/racerxdl/spy2go/spyserver"
+	"github.com/racerxdl/spy2go/spyserver/spyservertest"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeAirspy struct {
+	dropped uint64
+}
+
+func (d *fakeAirspy) IsStreaming() bool          { return true }
+func (d *fakeAirspy) GetCenterFrequency() uint32 { return 106300000 }
+func (d *fakeAirspy) GetSampleRate() uint32      { return 10000000 }
+func (d *fakeAirspy) GetDroppedSamples() uint64  { return d.dropped }
+
+func scrape(t *testing.T, e *Exporter) string {
+	t.Helper()
+	var server = httptest.NewServer(e)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestExporter(t *testing.T) {
+	var e = NewExporter()
+	var client = spyserver.MakeSpyserverByFullHS("127.0.0.1:1")
+	if err := client.SetCenterFrequency(433920000); err != nil {
+		t.Fatal(err)
+	}
+	e.AddSpyserver("roof", client)
+	e.AddAirspy(`lab "2"`, &fakeAirspy{dropped: 42})
+
+	var body = scrape(t, e)
+	for _, line := range []string{
+		"# TYPE spy2go_spyserver_connected gauge",
+		`spy2go_spyserver_connected{receiver="roof"} 0`,
+		`spy2go_spyserver_center_frequency_hertz{receiver="roof"} 4.3392e+08`,
+		"# TYPE spy2go_spyserver_stream_frames_total counter",
+		`spy2go_spyserver_stream_frames_total{receiver="roof",stream="iq"} 0`,
+		"# TYPE spy2go_spyserver_ping_latency_min_seconds gauge",
+		"# TYPE spy2go_spyserver_ping_latency_max_seconds gauge",
+		`spy2go_airspy_dropped_samples_total{receiver="lab \"2\""} 42`,
+		`spy2go_airspy_streaming{receiver="lab \"2\""} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+
+	if strings.Count(body, "# TYPE spy2go_spyserver_stream_frames_total ") != 1 {
+		t.Error("expected each family to be declared once")
+	}
+
+	e.Remove("roof")
+	if body = scrape(t, e); strings.Contains(body, "spy2go_spyserver_") {
+		t.Errorf("expected no spyserver metrics after Remove, got\n%s", body)
+	}
+}
+
+func TestExporterConnected(t *testing.T) {
+	var server = spyservertest.NewServer()
+	defer server.Close()
+
+	var client = spyserver.MakeSpyserverByFullHS(server.Addr)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Waits for a gap of 5 IQ frames
+	var deadline = time.Now().Add(2 * time.Second)
+	for client.Stats().IQ.Frames == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for IQ frames")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	server.SkipSequence(spyserver.StreamTypeIQ, 5)
+	for client.Stats().IQ.DroppedFrames == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the sequence gap")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var e = NewExporter()
+	e.AddSpyserver("roof", client)
+
+	var body = scrape(t, e)
+	for _, line := range []string{
+		`spy2go_spyserver_connected{receiver="roof"} 1`,
+		`spy2go_spyserver_streaming{receiver="roof"} 1`,
+		`spy2go_spyserver_stream_dropped_frames_total{receiver="roof",stream="iq"} 5`,
+		`spy2go_spyserver_stream_gaps_total{receiver="roof",stream="iq"} 1`,
+		`spy2go_spyserver_stream_frames_total{receiver="roof",stream="fft"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestFamiliesEscaping(t *testing.T) {
+	var fs = newFamilies()
+	fs.add("test_metric", "Help with \\ and\nnewline.", gauge, 1.5, "label", "a\\b\nc")
+
+	var b strings.Builder
+	if err := fs.write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected = "# HELP test_metric Help with \\\\ and\\nnewline.\n" +
+		"# TYPE test_metric gauge\n" +
+		"test_metric{label=\"a\\\\b\\nc\"} 1.5\n"
+	if b.String() != expected {
+		t.Fatalf("unexpected output\n%s", b.String())
+	}
+}
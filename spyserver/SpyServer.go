@@ -3,58 +3,59 @@
 package spyserver
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/racerxdl/spy2go/spyserver/wire"
 	"github.com/racerxdl/spy2go/spytypes"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
-func min(a, b uint32) uint32 {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 // Spyserver connection handler.
 // Use MakeSpyserver or MakeSpyserverFullHS to create an instance.
+// All methods are safe for concurrent use.
 type Spyserver struct {
 	fullhostname string
-	callback     spytypes.Callback
-	client       net.Conn
-
-	terminated     bool
-	routineRunning bool
-	gotDeviceInfo  bool
-	gotSyncInfo    bool
-	streamingMode  uint32
-	gain           uint32
-
-	availableSampleRates []uint32
-
-	parserPhase        uint32
-	deviceInfo         deviceInfo
-	header             messageHeader
-	lastSequenceNumber uint32
-	droppedBuffers     uint32
-	downStreamBytes    uint64
-	parserPosition     uint32
-	bodyBuffer         []uint8
-	headerBuffer       []uint8
-
-	Streaming      bool
-	CanControl     bool
-	IsConnected    bool
-	DroppedBuffers uint32
-
-	MinimumTunableFrequency uint32
-	MaximumTunableFrequency uint32
-	DeviceCenterFrequency   uint32
+
+	// connMtx serializes Connect and Disconnect
+	connMtx sync.Mutex
+
+	// mtx guards all fields below, up to the parser state
+	mtx         sync.Mutex
+	handler     spytypes.Handler
+	iqChannels  []*spytypes.FrameChannel[spytypes.SampleBlock]
+	fftChannels []*spytypes.FrameChannel[spytypes.FFTFrame]
+	afChannels  []*spytypes.FrameChannel[spytypes.AudioFrame]
+	client      net.Conn
+
+	gotDeviceInfo bool
+	gotSyncInfo   bool
+	streamingMode uint32
+	iqFormat      uint32
+	fftFormat     uint32
+	gain          uint32
+
+	sampleRates []SampleRate
+	deviceInfo  DeviceInfo
+	lastSync    ClientSync
+	gainTables  map[uint32][]float32
+
+	streaming  bool
+	canControl bool
+	connected  bool
+
+	minimumTunableFrequency uint32
+	maximumTunableFrequency uint32
+	deviceCenterFrequency   uint32
 	channelCenterFrequency  uint32
-	DisplayCenterFrequency  uint32
+	displayCenterFrequency  uint32
 
 	currentSampleRate           uint32
 	currentDisplaySampleRate    uint32
@@ -64,31 +65,68 @@ type Spyserver struct {
 	displayRange                int32
 	displayPixels               uint32
 
-	msgChannel chan []uint8
+	// iqStreamFrequency and iqStreamDecimation are the parameters confirmed by the server for the IQ stream.
+	// iqRetuned marks the next IQ block as the first one after a change.
+	iqStreamFrequency  uint32
+	iqStreamDecimation uint32
+	iqRetuned          bool
+
+	err              error
+	done             chan struct{}
+	stopCancel       context.CancelFunc
+	handshakeTimeout time.Duration
+	reconnectPolicy  *ReconnectPolicy
+	settings         map[uint32][]uint32
+
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	keepaliveTimedOut bool
+	pendingPings      []pendingPing
+	latency           LatencyStats
+	pendingReads      map[uint32][]chan uint32
+	stats             *connStats
+	totals            Stats
+	reconnects        uint64
+	writeBuffer       []uint8
+
+	// Parser state, only touched by the goroutine that is reading from the connection
+	decoder       *wire.Decoder
+	header        messageHeader
+	bodyBuffer    []uint8
+	receivedAt    time.Time
+	iqSampleIndex uint64
+	fftFrameIndex uint64
+	afSampleIndex uint64
 }
 
 // MakeSpyserverByFullHS creates an instance of Spyserver by giving hostname + port.
 // Example: MakeSpyserverByFullHS("airspy.com:5555")
 func MakeSpyserverByFullHS(fullhostname string) *Spyserver {
 	var s = &Spyserver{
-		fullhostname:         fullhostname,
-		callback:             nil,
-		terminated:           false,
-		gotDeviceInfo:        false,
-		gotSyncInfo:          false,
-		parserPhase:          parserAcquiringHeader,
-		Streaming:            false,
-		CanControl:           false,
-		IsConnected:          false,
-		availableSampleRates: []uint32{},
-		headerBuffer:         make([]uint8, messageHeaderSize),
+		fullhostname:     fullhostname,
+		gotDeviceInfo:    false,
+		gotSyncInfo:      false,
+		streaming:        false,
+		canControl:       false,
+		connected:        false,
+		sampleRates:      []SampleRate{},
+		handshakeTimeout: defaultHandshakeTimeout,
 
 		displayOffset:               0,
 		displayRange:                defaultFFTRange,
 		displayPixels:               defaultDisplayPixels,
 		streamingMode:               StreamModeIQOnly,
+		iqFormat:                    StreamFormatInt16,
+		fftFormat:                   StreamFormatUint8,
 		displayDecimationStageCount: 1,
 	}
+	s.settings = s.defaultSettings()
+	s.pendingReads = map[uint32][]chan uint32{}
+	s.gainTables = map[uint32][]float32{}
+	for deviceType, table := range defaultGainTables {
+		s.gainTables[deviceType] = table
+	}
+	s.stats = newConnStats()
 	s.cleanup()
 	return s
 }
@@ -96,296 +134,362 @@ func MakeSpyserverByFullHS(fullhostname string) *Spyserver {
 // MakeSpyserver creates an instance of Spyserver by giving hostname and port as separated parameters.
 // Example: MakeSpyserver("airspy.com", 5555)
 func MakeSpyserver(hostname string, port int) *Spyserver {
-	var s = &Spyserver{
-		fullhostname:         fmt.Sprintf("%s:%d", hostname, port),
-		callback:             nil,
-		terminated:           false,
-		gotDeviceInfo:        false,
-		gotSyncInfo:          false,
-		parserPhase:          parserAcquiringHeader,
-		Streaming:            false,
-		CanControl:           false,
-		IsConnected:          false,
-		availableSampleRates: []uint32{},
-		headerBuffer:         make([]uint8, messageHeaderSize),
-
-		displayOffset:               0,
-		displayRange:                defaultFFTRange,
-		displayPixels:               defaultDisplayPixels,
-		streamingMode:               StreamModeIQOnly,
-		displayDecimationStageCount: 1,
-	}
-	s.cleanup()
-	return s
+	return MakeSpyserverByFullHS(fmt.Sprintf("%s:%d", hostname, port))
 }
 
 // region Private Methods
 
 // sayHello sends a Hello Command to the server, with the Software ID (in this case, spy2go)
-func (f *Spyserver) sayHello() bool {
-	var totalLength = 4
-	var softwareVersionBytes = []byte(SoftwareID)
-	totalLength += len(softwareVersionBytes)
-
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, uint32(SpyserverProtocolVersion))
-	binary.Write(buf, binary.LittleEndian, softwareVersionBytes)
-
-	return f.sendCommand(cmdHello, buf.Bytes())
+// Must be called with mtx held.
+func (f *Spyserver) sayHello() error {
+	return f.writeCommand(wire.AppendHello(f.writeBuffer[:0], SpyserverProtocolVersion, SoftwareID))
 }
 
 // cleanup Cleans up all variables and returns to its default states.
+// Must be called with mtx held.
 func (f *Spyserver) cleanup() {
-	f.deviceInfo.DeviceType = DeviceInvalid
-	f.deviceInfo.DeviceSerial = 0
-	f.deviceInfo.DecimationStageCount = 0
-	f.deviceInfo.GainStageCount = 0
-	f.deviceInfo.MaximumSampleRate = 0
-	f.deviceInfo.MaximumBandwidth = 0
-	f.deviceInfo.MaximumGainIndex = 0
-	f.deviceInfo.MinimumFrequency = 0
-	f.deviceInfo.MaximumFrequency = 0
+	f.deviceInfo = DeviceInfo{DeviceType: DeviceInvalid}
+	f.lastSync = ClientSync{}
+	f.sampleRates = []SampleRate{}
 
 	f.gain = 0
-	f.CanControl = false
+	f.canControl = false
 	f.gotDeviceInfo = false
 	f.gotSyncInfo = false
 
-	f.lastSequenceNumber = 0xFFFFFFFF
-	f.droppedBuffers = 0
-	f.downStreamBytes = 0
-	f.parserPhase = parserAcquiringHeader
-	f.parserPosition = 0
-
-	f.Streaming = false
-	f.terminated = true
+	f.streaming = false
+	f.keepaliveTimedOut = false
+	f.cancelPings()
+	f.cancelReads()
 }
 
-// onConnect is executed just after a connection is made with spyserver and got a synchronization info.
-// It updates all settings on spyserver
-func (f *Spyserver) onConnect() {
-	f.setSetting(settingStreamingMode, []uint32{f.streamingMode})
-	f.setSetting(settingIqFormat, []uint32{StreamFormatInt16})
-	f.setSetting(settingFFTFormat, []uint32{StreamFormatUint8})
-	f.setSetting(settingFFTDisplayPixels, []uint32{f.displayPixels})
-	f.setSetting(settingFFTDbOffset, []uint32{uint32(f.displayOffset)})
-	f.setSetting(settingFFTDbRange, []uint32{uint32(f.displayRange)})
-	f.setSetting(settingFFTDecimation, []uint32{1})
+// resetParser returns the message parser to its initial state, reading from conn.
+// Must be called by the goroutine that reads from the connection.
+func (f *Spyserver) resetParser(conn io.Reader) {
+	f.decoder = wire.NewDecoder(bufio.NewReaderSize(countingReader{r: conn, f: f}, 64*1024))
+	f.iqSampleIndex = 0
+	f.fftFrameIndex = 0
+	f.afSampleIndex = 0
+}
 
-	var sampleRates = make([]uint32, f.deviceInfo.DecimationStageCount)
-	for i := uint32(0); i < f.deviceInfo.DecimationStageCount; i++ {
-		var decim = uint32(1 << i)
-		sampleRates[i] = uint32(float32(f.deviceInfo.MaximumSampleRate) / float32(decim))
+// defaultSettings returns the settings that are sent on the first connection.
+func (f *Spyserver) defaultSettings() map[uint32][]uint32 {
+	return map[uint32][]uint32{
+		SettingStreamingMode:    {f.streamingMode},
+		SettingIqFormat:         {f.iqFormat},
+		SettingFFTFormat:        {f.fftFormat},
+		SettingFFTDisplayPixels: {f.displayPixels},
+		SettingFFTDbOffset:      {uint32(f.displayOffset)},
+		SettingFFTDbRange:       {uint32(f.displayRange)},
+		SettingFFTDecimation:    {f.displayDecimationStageCount},
 	}
-	f.availableSampleRates = sampleRates
 }
 
-// setSetting changes a setting in Spyserver
-func (f *Spyserver) setSetting(settingType uint32, params []uint32) bool {
-	var argBytes = make([]uint8, 0)
-
-	if len(params) > 0 {
-		buf := new(bytes.Buffer)
-		binary.Write(buf, binary.LittleEndian, settingType)
-		for i := 0; i < len(params); i++ {
-			binary.Write(buf, binary.LittleEndian, params[i])
+// onConnect is executed just after a connection is made with spyserver and got a synchronization info.
+// It updates all settings on spyserver, replaying everything that was set in previous connections.
+// Must be called with mtx held.
+func (f *Spyserver) onConnect() error {
+	f.sampleRates = buildSampleRates(f.deviceInfo)
+
+	if params, ok := f.settings[SettingIqDecimation]; ok && f.validIQStage(params[0]) != nil {
+		log.Printf("Decimation stage %d is not available on this device, using %d\n", params[0], f.deviceInfo.MinimumIQDecimation)
+		f.settings[SettingIqDecimation] = []uint32{f.deviceInfo.MinimumIQDecimation}
+		f.channelDecimationStageCount = f.deviceInfo.MinimumIQDecimation
+		f.currentSampleRate = 0
+		if f.validIQStage(f.channelDecimationStageCount) == nil {
+			f.currentSampleRate = f.sampleRates[f.channelDecimationStageCount].SampleRate
 		}
-		argBytes = buf.Bytes()
 	}
 
-	return f.sendCommand(cmdSetSetting, argBytes)
-}
+	if forced := f.deviceInfo.ForcedIQFormat; forced != 0 && forced != f.iqFormat {
+		log.Printf("Server forces IQ format %d\n", forced)
+		f.iqFormat = forced
+		f.settings[SettingIqFormat] = []uint32{forced}
+	}
 
-// sendCommand sends a command to spyserver
-func (f *Spyserver) sendCommand(cmd uint32, args []uint8) bool {
-	if f.client == nil {
-		return false
+	f.iqStreamFrequency = f.lastSync.IQCenterFrequency
+	f.iqStreamDecimation = f.channelDecimationStageCount
+	f.iqRetuned = true
+
+	for _, settingType := range replayOrder {
+		if params, ok := f.settings[settingType]; ok {
+			if err := f.setSetting(settingType, params); err != nil {
+				return err
+			}
+		}
 	}
 
-	var argsLen = uint32(0)
-	if args != nil {
-		argsLen += uint32(len(args))
+	if params, ok := f.settings[SettingStreamingEnabled]; ok {
+		f.streaming = params[0] != 0
 	}
 
-	var buff = new(bytes.Buffer)
+	return nil
+}
 
-	var header = commandHeader{
-		CommandType: cmd,
-		BodySize:    argsLen,
-	}
+// setSetting changes a setting in Spyserver
+// Must be called with mtx held.
+func (f *Spyserver) setSetting(settingType uint32, params []uint32) error {
+	f.settings[settingType] = append([]uint32(nil), params...)
 
-	err := binary.Write(buff, binary.LittleEndian, &header)
-	if err != nil {
-		panic(err)
+	if err := f.writeCommand(wire.AppendSetSetting(f.writeBuffer[:0], settingType, params...)); err != nil {
+		return err
 	}
 
-	if args != nil {
-		for i := 0; i < len(args); i++ {
-			buff.WriteByte(byte(args[i]))
-		}
+	if settingType == SettingIqDecimation && len(params) > 0 {
+		return f.trackDecimation(params[0])
 	}
 
-	_, err = f.client.Write(buff.Bytes())
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
+	return nil
+}
+
+// trackDecimation sends a ping after an IQ decimation change.
+// The server handles the commands in order, so the IQ blocks after the pong have the new sample rate.
+// Must be called with mtx held.
+func (f *Spyserver) trackDecimation(stage uint32) error {
+	f.pendingPings = append(f.pendingPings, pendingPing{
+		purpose: pingBarrier,
+		sent:    time.Now(),
+		onPong: func() {
+			if f.iqStreamDecimation != stage {
+				f.iqStreamDecimation = stage
+				f.iqRetuned = true
+			}
+		},
+	})
 
-	return true
+	return f.sendCommand(cmdPing, nil)
 }
 
-func (f *Spyserver) parseMessage(buffer []uint8) {
-	f.downStreamBytes++
+// updateSetting changes a setting that is also sent by onConnect.
+// If there is no active connection, nothing is sent and the setting is applied on the next Connect.
+// Must be called with mtx held.
+func (f *Spyserver) updateSetting(settingType uint32, value uint32) error {
+	if !f.connected {
+		f.settings[settingType] = []uint32{value}
+		return nil
+	}
 
-	consumed := uint32(0)
-	for len(buffer) > 0 && !f.terminated {
-		if f.parserPhase == parserAcquiringHeader {
-			for f.parserPhase == parserAcquiringHeader && len(buffer) > 0 {
-				consumed = f.parseHeader(buffer)
-				buffer = buffer[consumed:]
-			}
+	return f.setSetting(settingType, []uint32{value})
+}
 
-			if f.parserPhase == parserReadingData {
-				clientMajor := uint8((SpyserverProtocolVersion >> 24) & 0xFF)
-				clientMinor := uint8((SpyserverProtocolVersion >> 16) & 0xFF)
+// sendCommand sends a command to spyserver
+// Must be called with mtx held.
+func (f *Spyserver) sendCommand(cmd uint32, args []uint8) error {
+	return f.writeCommand(wire.AppendCommand(f.writeBuffer[:0], cmd, args))
+}
 
-				serverMajor := uint8((f.header.ProtocolID >> 24) & 0xFF)
-				serverMinor := uint8((f.header.ProtocolID >> 16) & 0xFF)
-				//serverBuild := uint16(f.header.ProtocolID & 0xFFFF)
+// writeCommand writes an encoded command to spyserver, keeping the buffer for the next one.
+// Must be called with mtx held.
+func (f *Spyserver) writeCommand(b []uint8) error {
+	f.writeBuffer = b[:0]
 
-				if clientMajor != serverMajor || clientMinor != serverMinor {
-					panic("Server is running an unsupported protocol version.")
-				}
+	if f.client == nil {
+		return ErrNotConnected
+	}
 
-				if f.header.BodySize > spyserverMaxMessageBodySize {
-					panic("Server sent more than expected body size.")
-				}
+	_, err := f.client.Write(b)
+	return err
+}
 
-				f.bodyBuffer = make([]uint8, f.header.BodySize)
-			}
-		}
+// getIQSinks returns the handler and the IQ channels, to be used without holding mtx.
+func (f *Spyserver) getIQSinks() (spytypes.Handler, []*spytypes.FrameChannel[spytypes.SampleBlock]) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.handler, f.iqChannels
+}
 
-		if f.parserPhase == parserReadingData {
-			consumed = f.parseBody(buffer)
-			buffer = buffer[consumed:]
-
-			if f.parserPhase == parserAcquiringHeader {
-				if f.header.StreamType == StreamTypeIQ {
-					gap := f.header.SequenceNumber - f.lastSequenceNumber - 1
-					f.lastSequenceNumber = f.header.SequenceNumber
-					f.droppedBuffers += gap
-					if gap > 0 {
-						log.Printf("Lost %d frames from spyserver!\n", gap)
-					}
-				}
-				f.handleNewMessage()
-			}
-		}
+// sendFrame delivers a frame to all channels
+func sendFrame[T any](channels []*spytypes.FrameChannel[T], frame T) {
+	for _, c := range channels {
+		c.Send(frame)
 	}
 }
 
-func (f *Spyserver) parseHeader(buffer []uint8) uint32 {
-	consumed := uint32(0)
+// closeChannels closes all IQ, FFT and audio channels. Any Send blocked by OverflowBlock returns.
+func (f *Spyserver) closeChannels() {
+	f.mtx.Lock()
+	var iqChannels = f.iqChannels
+	var fftChannels = f.fftChannels
+	var afChannels = f.afChannels
+	f.addChannelDrops(&f.totals)
+	f.iqChannels = nil
+	f.fftChannels = nil
+	f.afChannels = nil
+	f.mtx.Unlock()
+
+	for _, c := range iqChannels {
+		c.Close()
+	}
+	for _, c := range fftChannels {
+		c.Close()
+	}
+	for _, c := range afChannels {
+		c.Close()
+	}
+}
 
-	for len(buffer) > 0 {
-		toWrite := min(messageHeaderSize-f.parserPosition, uint32(len(buffer)))
-		for i := uint32(0); i < toWrite; i++ {
-			f.headerBuffer[i+f.parserPosition] = buffer[i]
-		}
-		buffer = buffer[toWrite:]
-		consumed += toWrite
-		f.parserPosition += toWrite
-
-		if f.parserPosition == messageHeaderSize {
-			f.parserPosition = 0
-			buf := bytes.NewReader(f.headerBuffer)
-			err := binary.Read(buf, binary.LittleEndian, &f.header)
-			if err != nil {
-				panic(err)
-			}
+// getHandler returns a copy of the current handler. The handler functions must be invoked without holding mtx,
+// so they can call back into Spyserver.
+func (f *Spyserver) getHandler() spytypes.Handler {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.handler
+}
 
-			if f.header.BodySize > 0 {
-				f.parserPhase = parserReadingData
-			}
+// readMessage reads the next message from the connection and handles it.
+func (f *Spyserver) readMessage() error {
+	header, body, err := f.decoder.ReadMessage()
+	if err != nil {
+		return err
+	}
 
-			return consumed
+	if !wire.Compatible(header.ProtocolID, SpyserverProtocolVersion) {
+		return &ProtocolVersionError{
+			Client: SpyserverProtocolVersion,
+			Server: header.ProtocolID,
 		}
 	}
 
-	return consumed
+	f.header = header
+	f.bodyBuffer = body
+
+	return f.messageReceived()
 }
 
-func (f *Spyserver) parseBody(buffer []uint8) uint32 {
-	consumed := uint32(0)
+// messageReceived is called when the current message is complete
+func (f *Spyserver) messageReceived() error {
+	f.receivedAt = time.Now()
+	f.accountMessage()
 
-	for len(buffer) > 0 {
-		toWrite := min(f.header.BodySize-f.parserPosition, uint32(len(buffer)))
-		for i := uint32(0); i < toWrite; i++ {
-			f.bodyBuffer[i+f.parserPosition] = buffer[i]
-		}
-		buffer = buffer[toWrite:]
-		consumed += toWrite
-		f.parserPosition += toWrite
-
-		if f.parserPosition == f.header.BodySize {
-			f.parserPosition = 0
-			f.parserPhase = parserAcquiringHeader
-			return consumed
-		}
+	err := f.handleNewMessage()
+	if errors.Is(err, ErrMalformedMessage) {
+		f.decodeError()
 	}
 
-	return consumed
+	return err
 }
 
-func (f *Spyserver) processDeviceInfo() {
-	var dInfo = deviceInfo{}
-
-	buf := bytes.NewReader(f.bodyBuffer)
-	err := binary.Read(buf, binary.LittleEndian, &dInfo)
+func (f *Spyserver) processDeviceInfo() error {
+	dInfo, err := wire.DecodeDeviceInfo(f.bodyBuffer)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: device info: %v", ErrMalformedMessage, err)
 	}
 
+	f.mtx.Lock()
 	f.deviceInfo = dInfo
 	f.gotDeviceInfo = true
+	f.mtx.Unlock()
+
+	return nil
 }
 
-func (f *Spyserver) processClientSync() {
-	var clientSync = clientSync{}
+// syncState converts the synchronization info to the handler type
+func syncState(s ClientSync) spytypes.DeviceSyncState {
+	return spytypes.DeviceSyncState{
+		CanControl:                s.CanControl != 0,
+		Gain:                      s.Gain,
+		DeviceCenterFrequency:     s.DeviceCenterFrequency,
+		IQCenterFrequency:         s.IQCenterFrequency,
+		FFTCenterFrequency:        s.FFTCenterFrequency,
+		MinimumIQCenterFrequency:  s.MinimumIQCenterFrequency,
+		MaximumIQCenterFrequency:  s.MaximumIQCenterFrequency,
+		MinimumFFTCenterFrequency: s.MinimumFFTCenterFrequency,
+		MaximumFFTCenterFrequency: s.MaximumFFTCenterFrequency,
+	}
+}
 
-	buf := bytes.NewReader(f.bodyBuffer)
-	err := binary.Read(buf, binary.LittleEndian, &clientSync)
+func (f *Spyserver) processClientSync() error {
+	clientSync, err := wire.DecodeClientSync(f.bodyBuffer)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("%w: client sync: %v", ErrMalformedMessage, err)
 	}
 
-	f.CanControl = clientSync.CanControl != 0
+	f.mtx.Lock()
+	var event = spytypes.DeviceSyncEvent{
+		Old:   syncState(f.lastSync),
+		New:   syncState(clientSync),
+		First: !f.gotSyncInfo,
+	}
+	f.lastSync = clientSync
+	f.canControl = clientSync.CanControl != 0
 	f.gain = clientSync.Gain
-	f.DeviceCenterFrequency = clientSync.DeviceCenterFrequency
+	f.deviceCenterFrequency = clientSync.DeviceCenterFrequency
 	//f.channelCenterFrequency = clientSync.DeviceCenterFrequency
-	f.DisplayCenterFrequency = clientSync.FFTCenterFrequency
+	f.displayCenterFrequency = clientSync.FFTCenterFrequency
+	if f.iqStreamFrequency != clientSync.IQCenterFrequency {
+		f.iqStreamFrequency = clientSync.IQCenterFrequency
+		f.iqRetuned = true
+	}
 
-	if f.streamingMode == StreamModeFFTOnly || f.streamingMode == StreamModeFFTIQ {
-		f.MinimumTunableFrequency = clientSync.MinimumFFTCenterFrequency
-		f.MaximumTunableFrequency = clientSync.MaximumFFTCenterFrequency
-	} else if f.streamingMode == StreamModeIQOnly {
-		f.MinimumTunableFrequency = clientSync.MinimumIQCenterFrequency
-		f.MaximumTunableFrequency = clientSync.MaximumIQCenterFrequency
+	if f.streamingMode&StreamTypeFFT != 0 {
+		f.minimumTunableFrequency = clientSync.MinimumFFTCenterFrequency
+		f.maximumTunableFrequency = clientSync.MaximumFFTCenterFrequency
+	} else {
+		f.minimumTunableFrequency = clientSync.MinimumIQCenterFrequency
+		f.maximumTunableFrequency = clientSync.MaximumIQCenterFrequency
 	}
 
 	f.gotSyncInfo = true
+	f.mtx.Unlock()
 
 	//log.Println(clientSync)
 
-	if f.callback != nil {
-		f.callback.OnData(spytypes.DeviceSync, nil)
+	var h = f.getHandler()
+	if h.OnDeviceSync != nil {
+		h.OnDeviceSync()
+	}
+	if h.OnSyncEvent != nil {
+		h.OnSyncEvent(event)
+	}
+	if h.OnControlLost != nil && event.ControlLost() {
+		h.OnControlLost()
+	}
+	if h.OnControlRegained != nil && event.ControlRegained() {
+		h.OnControlRegained()
+	}
+
+	return nil
+}
+
+// sampleBlock returns a SampleBlock with the metadata of the current message and advances the sample index.
+func (f *Spyserver) sampleBlock(sampleCount uint32) spytypes.SampleBlock {
+	f.mtx.Lock()
+	var block = spytypes.SampleBlock{
+		SequenceNumber:  f.header.SequenceNumber,
+		StreamType:      f.header.StreamType,
+		MessageType:     f.header.MessageType,
+		CenterFrequency: f.iqStreamFrequency,
+		SampleRate:      f.currentSampleRate,
+		DecimationStage: f.iqStreamDecimation,
+		Timestamp:       f.receivedAt,
+		SampleIndex:     f.iqSampleIndex,
+		Retuned:         f.iqRetuned,
+	}
+	if f.iqStreamDecimation < uint32(len(f.sampleRates)) {
+		block.SampleRate = f.sampleRates[f.iqStreamDecimation].SampleRate
+	}
+	f.iqRetuned = false
+	f.mtx.Unlock()
+
+	f.iqSampleIndex += uint64(sampleCount)
+
+	return block
+}
+
+// deliverIQ sends a decoded block to OnSampleBlock and the IQ channels
+func deliverIQ(h spytypes.Handler, iqChannels []*spytypes.FrameChannel[spytypes.SampleBlock], block spytypes.SampleBlock) {
+	if h.OnSampleBlock != nil {
+		h.OnSampleBlock(block)
 	}
+	sendFrame(iqChannels, block)
 }
 
 func (f *Spyserver) processUInt8Samples() {
 	var sampleCount = f.header.BodySize / 2
+	var block = f.sampleBlock(sampleCount)
+	var h, iqChannels = f.getIQSinks()
 
-	if f.callback != nil {
+	if h.OnUInt8IQ != nil || h.OnSampleBlock != nil || len(iqChannels) > 0 {
 		var u8arr = make([]spytypes.ComplexUInt8, sampleCount)
 		buf := bytes.NewBuffer(f.bodyBuffer)
 
@@ -399,14 +503,20 @@ func (f *Spyserver) processUInt8Samples() {
 			}
 		}
 
-		f.callback.OnData(spytypes.SamplesComplexUInt8, u8arr)
+		if h.OnUInt8IQ != nil {
+			h.OnUInt8IQ(u8arr)
+		}
+		block.ComplexUInt8 = u8arr
+		deliverIQ(h, iqChannels, block)
 	}
 }
 
 func (f *Spyserver) processInt16Samples() {
 	var sampleCount = f.header.BodySize / 4
+	var block = f.sampleBlock(sampleCount)
+	var h, iqChannels = f.getIQSinks()
 	//var pairLength = sampleCount * 2
-	if f.callback != nil {
+	if h.OnInt16IQ != nil || h.OnSampleBlock != nil || len(iqChannels) > 0 {
 		var c16arr = make([]spytypes.ComplexInt16, sampleCount)
 		buf := bytes.NewBuffer(f.bodyBuffer)
 
@@ -425,14 +535,49 @@ func (f *Spyserver) processInt16Samples() {
 				Imag: tmp[i*2+1],
 			}
 		}
-		f.callback.OnData(spytypes.SamplesComplex32, c16arr)
+
+		if h.OnInt16IQ != nil {
+			h.OnInt16IQ(c16arr)
+		}
+		block.ComplexInt16 = c16arr
+		deliverIQ(h, iqChannels, block)
 	}
 }
 
+func (f *Spyserver) processInt24Samples() {
+	var sampleCount = f.header.BodySize / 6
+	var block = f.sampleBlock(sampleCount)
+	var h, iqChannels = f.getIQSinks()
+
+	if h.OnInt24IQ != nil || h.OnSampleBlock != nil || len(iqChannels) > 0 {
+		var c32arr = make([]spytypes.ComplexInt32, sampleCount)
+
+		for i := uint32(0); i < sampleCount; i++ {
+			c32arr[i] = spytypes.ComplexInt32{
+				Real: int24(f.bodyBuffer[i*6:]),
+				Imag: int24(f.bodyBuffer[i*6+3:]),
+			}
+		}
+
+		if h.OnInt24IQ != nil {
+			h.OnInt24IQ(c32arr)
+		}
+		block.ComplexInt32 = c32arr
+		deliverIQ(h, iqChannels, block)
+	}
+}
+
+// int24 decodes a packed 3 byte little endian signed integer
+func int24(b []uint8) int32 {
+	return int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+}
+
 func (f *Spyserver) processFloatSamples() {
 	var sampleCount = f.header.BodySize / 8
+	var block = f.sampleBlock(sampleCount)
+	var h, iqChannels = f.getIQSinks()
 
-	if f.callback != nil {
+	if h.OnFloatIQ != nil || h.OnSampleBlock != nil || len(iqChannels) > 0 {
 		var c64arr = make([]complex64, sampleCount)
 		buf := bytes.NewBuffer(f.bodyBuffer)
 
@@ -440,27 +585,102 @@ func (f *Spyserver) processFloatSamples() {
 			binary.Read(buf, binary.LittleEndian, &c64arr[i])
 		}
 
-		f.callback.OnData(spytypes.SamplesComplex64, c64arr)
+		if h.OnFloatIQ != nil {
+			h.OnFloatIQ(c64arr)
+		}
+		block.Complex64 = c64arr
+		deliverIQ(h, iqChannels, block)
 	}
 }
 
 func (f *Spyserver) processUInt8FFT() {
-	if f.callback != nil {
-		f.callback.OnData(spytypes.FFTUInt8, f.bodyBuffer)
+	// The body buffer is reused by the next message
+	f.processFFT(append([]uint8(nil), f.bodyBuffer...))
+}
+
+func (f *Spyserver) processDint4FFT() {
+	f.processFFT(decodeDint4FFT(f.bodyBuffer))
+}
+
+func (f *Spyserver) processCompressedFFT() {
+	bins, err := decodeCompressedFFT(f.bodyBuffer)
+	if err != nil {
+		// A bad frame is dropped, it doesn't affect the following ones
+		f.decodeError()
+		f.fftFrameIndex++
+		return
 	}
+	f.processFFT(bins)
 }
 
-func (f *Spyserver) handleNewMessage() {
-	if f.terminated {
+// processFFT delivers the decoded 8 bit FFT bins
+func (f *Spyserver) processFFT(bins []uint8) {
+	f.mtx.Lock()
+	var h = f.handler
+	var fftChannels = f.fftChannels
+	var frame = spytypes.FFTFrame{
+		SequenceNumber:  f.header.SequenceNumber,
+		StreamType:      f.header.StreamType,
+		MessageType:     f.header.MessageType,
+		CenterFrequency: f.displayCenterFrequency,
+		SampleRate:      f.currentDisplaySampleRate,
+		DecimationStage: f.displayDecimationStageCount,
+		Timestamp:       f.receivedAt,
+		FrameIndex:      f.fftFrameIndex,
+		Bins:            bins,
+	}
+	f.mtx.Unlock()
+
+	f.fftFrameIndex++
+
+	if h.OnFFT != nil {
+		h.OnFFT(bins)
+	}
+	if h.OnFFTFrame != nil {
+		h.OnFFTFrame(frame)
+	}
+	sendFrame(fftChannels, frame)
+}
+
+func (f *Spyserver) processAudio() {
+	samples, err := decodeAudio(f.header.MessageType, f.bodyBuffer)
+	if err != nil {
+		f.decodeError()
 		return
 	}
 
+	f.mtx.Lock()
+	var h = f.handler
+	var afChannels = f.afChannels
+	var frame = spytypes.AudioFrame{
+		SequenceNumber:  f.header.SequenceNumber,
+		MessageType:     f.header.MessageType,
+		CenterFrequency: f.iqStreamFrequency,
+		Timestamp:       f.receivedAt,
+		SampleIndex:     f.afSampleIndex,
+		Samples:         samples,
+	}
+	f.mtx.Unlock()
+
+	f.afSampleIndex += uint64(len(samples))
+
+	if h.OnAudio != nil {
+		h.OnAudio(frame)
+	}
+	sendFrame(afChannels, frame)
+}
+
+func (f *Spyserver) handleNewMessage() error {
 	switch f.header.MessageType {
 	case msgTypeDeviceInfo:
-		f.processDeviceInfo()
-		break
+		return f.processDeviceInfo()
 	case msgTypeClientSync:
-		f.processClientSync()
+		return f.processClientSync()
+	case msgTypePong:
+		f.processPong()
+		break
+	case msgTypeReadSetting:
+		f.processReadSetting()
 		break
 	case msgTypeUint8IQ:
 		f.processUInt8Samples()
@@ -468,346 +688,964 @@ func (f *Spyserver) handleNewMessage() {
 	case msgTypeInt16IQ:
 		f.processInt16Samples()
 		break
+	case msgTypeInt24IQ:
+		f.processInt24Samples()
+		break
 	case msgTypeFloatIQ:
 		f.processFloatSamples()
 		break
+	case msgTypeUint8AF, msgTypeInt16AF, msgTypeInt24AF, msgTypeFloatAF, msgTypeCompressedAF:
+		f.processAudio()
+		break
+	case msgTypeDint4FFT:
+		f.processDint4FFT()
+		break
 	case msgTypeUint8FFT:
 		f.processUInt8FFT()
 		break
+	case msgTypeCompressedFFT:
+		f.processCompressedFFT()
+		break
+	default:
+		f.unsupportedMessage()
 	}
+
+	return nil
 }
 
-func (f *Spyserver) setStreamState() bool {
-	if f.Streaming {
-		return f.setSetting(settingStreamingEnabled, []uint32{1})
+// setStreamState sends the streaming state to the server.
+// Must be called with mtx held.
+func (f *Spyserver) setStreamState() error {
+	if f.streaming {
+		return f.updateSetting(SettingStreamingEnabled, 1)
 	} else {
-		return f.setSetting(settingStreamingEnabled, []uint32{0})
+		return f.updateSetting(SettingStreamingEnabled, 0)
 	}
 }
 
-func (f *Spyserver) threadLoop() {
-	f.parserPhase = parserAcquiringHeader
-	f.parserPosition = 0
+// handshakeState returns whether the handshake is complete and whether the server reported no device.
+func (f *Spyserver) handshakeState() (complete bool, noDevice bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	noDevice = f.gotDeviceInfo && f.deviceInfo.DeviceType == DeviceInvalid
+	return f.gotDeviceInfo && f.gotSyncInfo, noDevice
+}
+
+// handshake waits for the device capability and synchronization info of a new connection.
+// It gives up after the handshake timeout or when ctx is done, whichever comes first.
+func (f *Spyserver) handshake(ctx context.Context, conn net.Conn) error {
+	f.mtx.Lock()
+	deadline := time.Now().Add(f.handshakeTimeout)
+	f.mtx.Unlock()
 
-	buffer := make([]uint8, 64*1024)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
 
-	for f.routineRunning && !f.terminated {
-		if f.terminated || !f.routineRunning {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+
+	// Unblocks the pending Read if ctx gets cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		err := f.readMessage()
+
+		complete, noDevice := f.handshakeState()
+		if noDevice {
+			return ErrNoDevice
+		}
+		if complete {
 			break
 		}
 
-		n, err := f.client.Read(buffer)
-
 		if err != nil {
-			if f.routineRunning && !f.terminated {
-				log.Println("Error receiving data: ", err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return ErrHandshakeTimeout
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	return conn.SetReadDeadline(time.Time{})
+}
+
+// dial opens a new connection to spyserver, waits for the handshake and sends all settings.
+// Must be called by the goroutine that reads from the connection.
+func (f *Spyserver) dial(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", f.fullhostname)
+	if err != nil {
+		return err
+	}
+
+	f.resetParser(conn)
+
+	f.mtx.Lock()
+	f.client = conn
+	f.cleanup()
+	f.resetStats()
+	err = f.sayHello()
+	f.mtx.Unlock()
+
+	if err == nil {
+		log.Println("Connected. Waiting for device info.")
+		err = f.handshake(ctx, conn)
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if err == nil {
+		f.connected = true
+		err = f.onConnect()
+	}
+
+	if err != nil {
+		conn.Close()
+		f.client = nil
+		f.connected = false
+		f.cleanup()
+	}
+
+	return err
+}
+
+// readLoop reads and parses the data from the current connection.
+// It returns nil if the connection was closed because ctx is done.
+func (f *Spyserver) readLoop(ctx context.Context) error {
+	f.mtx.Lock()
+	conn := f.client
+	var interval = f.keepaliveInterval
+	var timeout = f.keepaliveTimeout
+	f.mtx.Unlock()
+
+	// Unblocks the pending Read when Disconnect is called
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if interval > 0 {
+		kctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go f.keepalive(kctx, conn, interval, timeout)
+	}
+
+	for ctx.Err() == nil {
+		if err := f.readMessage(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			f.mtx.Lock()
+			var timedOut = f.keepaliveTimedOut
+			f.mtx.Unlock()
+			if timedOut {
+				return ErrKeepaliveTimeout
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconnect tries to connect again following the reconnect policy.
+// It returns the last error if it gives up, or nil when connected.
+func (f *Spyserver) reconnect(ctx context.Context, policy ReconnectPolicy, err error) error {
+	var lostAt = time.Now()
+
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		if h := f.getHandler(); h.OnReconnecting != nil {
+			h.OnReconnecting(spytypes.ReconnectInfo{
+				Attempt: attempt,
+				Err:     err,
+				LostAt:  lostAt,
+			})
+		}
+
+		var timer = time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		log.Printf("Reconnecting (attempt %d)\n", attempt)
+		err = f.dial(ctx)
+		if err == nil {
+			f.mtx.Lock()
+			f.reconnects++
+			f.mtx.Unlock()
+			if h := f.getHandler(); h.OnReconnected != nil {
+				h.OnReconnected(spytypes.ReconnectInfo{
+					Attempt: attempt,
+					LostAt:  lostAt,
+				})
 			}
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// threadLoop is the reader goroutine. It runs until ctx is done or the connection is lost for good.
+func (f *Spyserver) threadLoop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	var err error
+	for {
+		err = f.readLoop(ctx)
+
+		f.mtx.Lock()
+		f.client.Close()
+		f.client = nil
+		f.connected = false
+		var policy = f.reconnectPolicy
+		f.mtx.Unlock()
+
+		if err == nil || policy == nil {
 			break
 		}
-		if n > 0 {
-			var sl = buffer[:n]
-			f.parseMessage(sl)
+
+		err = f.reconnect(ctx, *policy, err)
+		if err == nil {
+			continue
 		}
+		if ctx.Err() != nil {
+			// Disconnect was called while reconnecting
+			err = nil
+		}
+		break
 	}
+
 	log.Println("Thread closing")
-	f.routineRunning = false
+	f.mtx.Lock()
+	f.err = err
 	f.cleanup()
+	f.mtx.Unlock()
+
+	f.closeChannels()
+
+	if h := f.getHandler(); err != nil && h.OnError != nil {
+		h.OnError(err)
+	}
 }
 
 // endregion
 // region Public Methods
 
+// DeviceInfo returns the capability info of the active device in spyserver.
+// The DeviceType is DeviceInvalid when not connected.
+func (f *Spyserver) DeviceInfo() DeviceInfo {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.deviceInfo
+}
+
+// LastSync returns the last synchronization info received from spyserver.
+// It is zero when not connected.
+func (f *Spyserver) LastSync() ClientSync {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.lastSync
+}
+
 // GetName returns the name of the active device in spyserver
 func (f *Spyserver) GetName() string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return DeviceName[f.deviceInfo.DeviceType]
 }
 
 // Start starts the streaming process (if not already started)
-func (f *Spyserver) Start() {
-	if !f.Streaming {
+// If not connected, the streaming starts on the next Connect.
+func (f *Spyserver) Start() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.streaming {
 		log.Println("Starting streaming")
-		f.Streaming = true
-		f.downStreamBytes = 0
-		f.setStreamState()
+		f.streaming = true
+		return f.setStreamState()
 	}
+
+	return nil
 }
 
 // Stop stop the streaming process (if started)
-func (f *Spyserver) Stop() {
-	if f.Streaming {
-		f.Streaming = false
-		f.downStreamBytes = 0
-		f.setStreamState()
+func (f *Spyserver) Stop() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.streaming {
+		f.streaming = false
+		return f.setStreamState()
 	}
+
+	return nil
 }
 
-// Connect initiates the connection with spyserver.
-// It panics if the connection fails for some reason.
-func (f *Spyserver) Connect() {
-	if f.routineRunning {
-		return
-	}
+// IsStreaming returns true if the streaming is enabled.
+func (f *Spyserver) IsStreaming() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.streaming
+}
 
-	log.Println("Trying to connect")
-	conn, err := net.Dial("tcp", f.fullhostname)
-	if err != nil {
-		panic(err)
-	}
+// IsConnected returns true if there is an active connection with spyserver.
+// While reconnecting, it returns false.
+func (f *Spyserver) IsConnected() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.connected
+}
 
-	f.client = conn
-	f.IsConnected = true
+// CanControl returns true if this client is allowed to change the device settings,
+// like center frequency and gain. Only one client in spyserver can control the device.
+func (f *Spyserver) CanControl() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.canControl
+}
 
-	f.sayHello()
-	f.cleanup()
+// GetDroppedBuffers returns how many IQ buffers were lost in the current connection.
+func (f *Spyserver) GetDroppedBuffers() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return uint32(f.stats.iq.DroppedFrames)
+}
 
-	f.terminated = false
-	f.gotSyncInfo = false
-	f.gotDeviceInfo = false
-	f.routineRunning = true
-
-	hasError := false
-	errorMsg := ""
-
-	go f.threadLoop()
-	log.Println("Connected. Waiting for device info.")
-	for i := 0; i < 1000 && !hasError; i++ {
-		if f.gotDeviceInfo {
-			if f.deviceInfo.DeviceType == DeviceInvalid {
-				errorMsg = "Server is up but no device is available"
-				hasError = true
-				break
-			}
+// Connect initiates the connection with spyserver.
+// It is the same as ConnectContext with a background context.
+func (f *Spyserver) Connect() error {
+	return f.ConnectContext(context.Background())
+}
 
-			if f.gotSyncInfo {
-				f.onConnect()
-				return
-			}
+// ConnectContext initiates the connection with spyserver.
+// The context only limits the connection and handshake, cancelling it afterwards doesn't close the connection.
+// It returns ErrNoDevice if the server has no device available and ErrHandshakeTimeout if the server
+// doesn't send the device capability and synchronization info within the handshake timeout.
+func (f *Spyserver) ConnectContext(ctx context.Context) error {
+	f.connMtx.Lock()
+	defer f.connMtx.Unlock()
+
+	f.mtx.Lock()
+	var running = f.done != nil
+	if running {
+		select {
+		case <-f.done:
+			running = false
+		default:
 		}
-		time.Sleep(4 * time.Millisecond)
 	}
+	f.err = nil
+	if !running {
+		f.latency = LatencyStats{}
+	}
+	f.mtx.Unlock()
 
-	f.Disconnect()
-	if hasError {
-		hasError = false
-		panic(errorMsg)
+	if running {
+		return nil
 	}
 
-	panic("Server didn't send the device capability and synchronization info.")
+	log.Println("Trying to connect")
+	if err := f.dial(ctx); err != nil {
+		return err
+	}
+
+	stopCtx, stopCancel := context.WithCancel(context.Background())
+	var done = make(chan struct{})
+
+	f.mtx.Lock()
+	f.stopCancel = stopCancel
+	f.done = done
+	f.mtx.Unlock()
+
+	go f.threadLoop(stopCtx, done)
+
+	return nil
 }
 
 // Disconnect disconnects from current connected spyserver.
+// It blocks until the reader goroutine has exited, so it must not be called from inside a handler function.
 func (f *Spyserver) Disconnect() {
+	f.connMtx.Lock()
+	defer f.connMtx.Unlock()
+
 	log.Println("Disconnecting")
-	f.terminated = true
-	if f.IsConnected {
-		f.client.Close()
+
+	f.mtx.Lock()
+	var stopCancel = f.stopCancel
+	var done = f.done
+	f.mtx.Unlock()
+
+	if stopCancel != nil {
+		stopCancel()
 	}
 
-	f.routineRunning = false
+	// Unblocks the reader if it is waiting on a channel with OverflowBlock
+	f.closeChannels()
 
+	if done != nil {
+		<-done
+	}
+
+	f.mtx.Lock()
+	f.connected = false
+	delete(f.settings, SettingStreamingEnabled)
 	f.cleanup()
+	f.mtx.Unlock()
+}
+
+// Close disconnects from spyserver, like Disconnect.
+// It always returns nil and exists to make Spyserver an io.Closer.
+func (f *Spyserver) Close() error {
+	f.Disconnect()
+	return nil
+}
+
+// Run enables the streaming and blocks until ctx is done or the connection is lost.
+// The streaming is disabled again before returning if the connection is still up.
+// It returns ctx.Err() when the context ends the run, or the error that closed the connection.
+func (f *Spyserver) Run(ctx context.Context) error {
+	f.mtx.Lock()
+	var connected = f.connected
+	var done = f.done
+	f.mtx.Unlock()
+
+	if !connected {
+		return ErrNotConnected
+	}
+
+	if err := f.Start(); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		f.Stop()
+		return ctx.Err()
+	case <-done:
+		if err := f.Err(); err != nil {
+			return err
+		}
+		return ErrNotConnected
+	}
+}
+
+// SetHandshakeTimeout sets how long Connect waits for the device capability and synchronization info.
+func (f *Spyserver) SetHandshakeTimeout(timeout time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.handshakeTimeout = timeout
+}
+
+// GetHandshakeTimeout returns how long Connect waits for the device capability and synchronization info.
+func (f *Spyserver) GetHandshakeTimeout() time.Duration {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.handshakeTimeout
+}
+
+// SetReconnectPolicy enables the automatic reconnection when the connection drops.
+// After reconnecting, all settings (streaming mode, frequencies, decimation, gain, display and streaming state) are
+// sent again and the handler receives a Reconnected event. Use nil to disable it, which is the default.
+func (f *Spyserver) SetReconnectPolicy(policy *ReconnectPolicy) {
+	if policy != nil {
+		var p = *policy
+		policy = &p
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.reconnectPolicy = policy
+}
+
+// Err returns the error that closed the last connection, or nil if it was closed by Disconnect.
+func (f *Spyserver) Err() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.err
 }
 
 // GetSampleRate returns the sample rate of the IQ channel in Hertz
 func (f *Spyserver) GetSampleRate() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.currentSampleRate
 }
 
 // SetSampleRate sets the sample rate of the IQ Channel in Hertz
-// Check the available sample rates using GetAvailableSampleRates
-// Returns InvalidValue in case of a invalid value in the input
-func (f *Spyserver) SetSampleRate(sampleRate uint32) uint32 {
-	for i := uint32(0); i < f.deviceInfo.DecimationStageCount; i++ {
-		if f.availableSampleRates[i] == sampleRate {
-			f.channelDecimationStageCount = i
-			f.setSetting(settingIqDecimation, []uint32{i})
-			f.currentSampleRate = sampleRate
-			if (f.streamingMode == StreamModeFFTOnly || f.streamingMode == StreamModeFFTIQ) && f.currentDisplaySampleRate == 0 {
-				f.SetDisplaySampleRate(sampleRate)
-			}
-			return sampleRate
-		}
+// Check the available sample rates using GetIQSampleRates
+// Returns ErrInvalidValue in case of a invalid value in the input
+func (f *Spyserver) SetSampleRate(sampleRate uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.connected {
+		return ErrNotConnected
 	}
 
-	return InvalidValue
+	i, err := f.findStage(sampleRate, f.deviceInfo.MinimumIQDecimation)
+	if err != nil {
+		return err
+	}
+
+	f.channelDecimationStageCount = i
+	if err := f.setSetting(SettingIqDecimation, []uint32{i}); err != nil {
+		return err
+	}
+	f.currentSampleRate = sampleRate
+	if f.streamingMode&StreamTypeFFT != 0 && f.currentDisplaySampleRate == 0 {
+		return f.setDisplaySampleRate(sampleRate)
+	}
+	return nil
 }
 
 // SetDecimationStage sets the sample rate by using the number of decimation stages.
 // Each decimation stage decimates by two, then the total decimation will be defined by 2^stages.
 // This is the same as SetSampleRate, but SetSampleRate instead, looks at a pre-filled table of all 2^stages
 // decimations that the server supports and applies into the original device sample rate.
-func (f *Spyserver) SetDecimationStage(decimation uint32) uint32 {
-	if decimation > f.deviceInfo.DecimationStageCount {
-		return InvalidValue
+// Returns ErrInvalidValue if the stage doesn't exist or is below the device MinimumIQDecimation
+func (f *Spyserver) SetDecimationStage(decimation uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.connected {
+		return ErrNotConnected
+	}
+	if err := f.validIQStage(decimation); err != nil {
+		return err
 	}
 	f.channelDecimationStageCount = decimation
-	f.setSetting(settingIqDecimation, []uint32{decimation})
-	f.currentSampleRate = f.availableSampleRates[decimation]
+	if err := f.setSetting(SettingIqDecimation, []uint32{decimation}); err != nil {
+		return err
+	}
+	f.currentSampleRate = f.sampleRates[decimation].SampleRate
 
-	return decimation
+	return nil
 }
 
 // GetCenterFrequency returns the IQ Channel Center Frequency in Hz
 func (f *Spyserver) GetCenterFrequency() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.channelCenterFrequency
 }
 
-// SetCenterFrequency sets the IQ Channel Center Frequency in Hertz and returns it.
-func (f *Spyserver) SetCenterFrequency(centerFrequency uint32) uint32 {
+// SetCenterFrequency sets the IQ Channel Center Frequency in Hertz.
+// If not connected, the value is sent on the next Connect.
+func (f *Spyserver) SetCenterFrequency(centerFrequency uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	if f.channelCenterFrequency != centerFrequency {
-		f.setSetting(settingIqFrequency, []uint32{centerFrequency})
+		if err := f.updateSetting(SettingIqFrequency, centerFrequency); err != nil {
+			return err
+		}
 		f.channelCenterFrequency = centerFrequency
-		if (f.streamingMode == StreamModeFFTOnly || f.streamingMode == StreamModeFFTIQ) && f.DisplayCenterFrequency == 0 {
-			f.SetDisplayCenterFrequency(centerFrequency)
+		if f.streamingMode&StreamTypeFFT != 0 && f.displayCenterFrequency == 0 {
+			return f.setDisplayCenterFrequency(centerFrequency)
 		}
 	}
 
-	return f.channelCenterFrequency
+	return nil
+}
+
+// GetDeviceCenterFrequency returns the center frequency of the device in Hertz, as reported by the server.
+func (f *Spyserver) GetDeviceCenterFrequency() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.deviceCenterFrequency
+}
+
+// GetMinimumTunableFrequency returns the minimum center frequency in Hertz for the current streaming mode.
+func (f *Spyserver) GetMinimumTunableFrequency() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.minimumTunableFrequency
+}
+
+// GetMaximumTunableFrequency returns the maximum center frequency in Hertz for the current streaming mode.
+func (f *Spyserver) GetMaximumTunableFrequency() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.maximumTunableFrequency
 }
 
 // GetDisplayCenterFrequency returns the FFT Display Center Frequency in Hertz
 func (f *Spyserver) GetDisplayCenterFrequency() uint32 {
-	return f.DisplayCenterFrequency
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.displayCenterFrequency
 }
 
-// SetDisplayCenterFrequency sets the FFT Channel Center Frequency in Hertz and returns it.
-func (f *Spyserver) SetDisplayCenterFrequency(centerFrequency uint32) uint32 {
-	if f.DisplayCenterFrequency != centerFrequency {
-		f.setSetting(settingFFTFrequency, []uint32{centerFrequency})
-		f.DisplayCenterFrequency = centerFrequency
+// SetDisplayCenterFrequency sets the FFT Channel Center Frequency in Hertz.
+// If not connected, the value is sent on the next Connect.
+func (f *Spyserver) SetDisplayCenterFrequency(centerFrequency uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.setDisplayCenterFrequency(centerFrequency)
+}
+
+func (f *Spyserver) setDisplayCenterFrequency(centerFrequency uint32) error {
+	if f.displayCenterFrequency != centerFrequency {
+		if err := f.updateSetting(SettingFFTFrequency, centerFrequency); err != nil {
+			return err
+		}
+		f.displayCenterFrequency = centerFrequency
 	}
 
-	return f.DisplayCenterFrequency
+	return nil
 }
 
 // SetDisplayOffset sets the FFT Display offset in dB
-func (f *Spyserver) SetDisplayOffset(offset int32) {
+// If not connected, the value is sent on the next Connect.
+func (f *Spyserver) SetDisplayOffset(offset int32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	if f.displayOffset != offset {
 		f.displayOffset = offset
-		f.setSetting(settingFFTDbOffset, []uint32{uint32(offset)})
+		return f.updateSetting(SettingFFTDbOffset, uint32(offset))
 	}
+
+	return nil
 }
 
 // GetDisplayOffset returns the FFT Display offset in dB
 func (f *Spyserver) GetDisplayOffset() int32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.displayOffset
 }
 
 // SetDisplayRange sets the FFT Display range in dB
-func (f *Spyserver) SetDisplayRange(dispRange int32) {
+// If not connected, the value is sent on the next Connect.
+func (f *Spyserver) SetDisplayRange(dispRange int32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	if f.displayRange != dispRange {
 		f.displayRange = dispRange
-		f.setSetting(settingFFTDbRange, []uint32{uint32(dispRange)})
+		return f.updateSetting(SettingFFTDbRange, uint32(dispRange))
 	}
+
+	return nil
 }
 
 // GetDisplayRange returns the FFT Display range in dB
 func (f *Spyserver) GetDisplayRange() int32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.displayRange
 }
 
 // SetDisplayPixels sets the FFT Display width in pixels
-func (f *Spyserver) SetDisplayPixels(pixels uint32) {
+// If not connected, the value is sent on the next Connect.
+func (f *Spyserver) SetDisplayPixels(pixels uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	if f.displayPixels != pixels {
 		f.displayPixels = pixels
-		f.setSetting(settingFFTDisplayPixels, []uint32{pixels})
+		return f.updateSetting(SettingFFTDisplayPixels, pixels)
 	}
+
+	return nil
 }
 
 // GetDisplayPixels returns the FFT Display width in pixels
 func (f *Spyserver) GetDisplayPixels() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.displayPixels
 }
 
+// SetIQFormat sets the format of the IQ samples sent by the server.
+// The valid values are StreamFormatUint8, StreamFormatInt16 (default), StreamFormatInt24 and StreamFormatFloat,
+// delivered to OnUInt8IQ, OnInt16IQ, OnInt24IQ and OnFloatIQ respectively.
+// If the server forces an IQ format, any other format returns ErrInvalidValue.
+// If not connected, the value is sent on the next Connect, unless the server forces another format.
+func (f *Spyserver) SetIQFormat(format uint32) error {
+	if format != StreamFormatUint8 && format != StreamFormatInt16 && format != StreamFormatInt24 && format != StreamFormatFloat {
+		return ErrInvalidValue
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if forced := f.deviceInfo.ForcedIQFormat; f.gotDeviceInfo && forced != 0 && forced != format {
+		return ErrInvalidValue
+	}
+
+	if f.iqFormat != format {
+		f.iqFormat = format
+		return f.updateSetting(SettingIqFormat, format)
+	}
+
+	return nil
+}
+
+// GetIQFormat returns the format of the IQ samples sent by the server.
+func (f *Spyserver) GetIQFormat() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.iqFormat
+}
+
+// SetFFTFormat sets the format of the FFT bins sent by the server.
+// The valid values are StreamFormatUint8 (default), StreamFormatDint4 and StreamFormatCompressed.
+// All of them are decoded to 8 bit bins, so the handler and channels don't change.
+// If not connected, the value is sent on the next Connect.
+func (f *Spyserver) SetFFTFormat(format uint32) error {
+	if format != StreamFormatUint8 && format != StreamFormatDint4 && format != StreamFormatCompressed {
+		return ErrInvalidValue
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.fftFormat != format {
+		f.fftFormat = format
+		return f.updateSetting(SettingFFTFormat, format)
+	}
+
+	return nil
+}
+
+// GetFFTFormat returns the format of the FFT bins sent by the server.
+func (f *Spyserver) GetFFTFormat() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.fftFormat
+}
+
 // SetStreamingMode sets the streaming mode of the server.
-// The valid values are StreamModeIQOnly, StreamModeFFTOnly, StreamModeFFTIQ
-func (f *Spyserver) SetStreamingMode(streamMode uint32) {
+// The valid values are StreamModeIQOnly, StreamModeAFOnly, StreamModeFFTOnly, StreamModeFFTIQ, StreamModeFFTAF
+// If not connected, the value is sent on the next Connect.
+func (f *Spyserver) SetStreamingMode(streamMode uint32) error {
+	switch streamMode {
+	case StreamModeIQOnly, StreamModeAFOnly, StreamModeFFTOnly, StreamModeFFTIQ, StreamModeFFTAF:
+	default:
+		return ErrInvalidValue
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
 	if f.streamingMode != streamMode {
 		f.streamingMode = streamMode
-		f.setSetting(settingStreamingMode, []uint32{streamMode})
+		if err := f.updateSetting(SettingStreamingMode, streamMode); err != nil {
+			return err
+		}
 
-		if (f.streamingMode == StreamModeFFTOnly || f.streamingMode == StreamModeFFTIQ) && f.DisplayCenterFrequency == 0 {
-			f.SetDisplayCenterFrequency(f.GetCenterFrequency())
+		if !f.connected {
+			return nil
 		}
-		if f.streamingMode == StreamModeFFTOnly || f.streamingMode == StreamModeFFTIQ {
-			f.setSetting(settingFFTDecimation, []uint32{f.displayDecimationStageCount})
+
+		if f.streamingMode&StreamTypeFFT != 0 && f.displayCenterFrequency == 0 {
+			if err := f.setDisplayCenterFrequency(f.channelCenterFrequency); err != nil {
+				return err
+			}
+		}
+		if f.streamingMode&StreamTypeFFT != 0 {
+			return f.setSetting(SettingFFTDecimation, []uint32{f.displayDecimationStageCount})
 		}
 	}
+
+	return nil
 }
 
 // GetStreamingMode returns the streaming mode of the server.
 func (f *Spyserver) GetStreamingMode() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.streamingMode
 }
 
-// SetCallback sets the callbacks for server data
+// SetHandler sets the handler functions for server data
+// The handler functions are called from the reader goroutine, so they should return quickly.
+func (f *Spyserver) SetHandler(h spytypes.Handler) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.handler = h
+}
+
+// IQChannel returns a channel that receives the IQ samples, buffering up to bufferDepth blocks.
+// The policy defines what happens when the buffer is full. OverflowBlock stalls the reader goroutine.
+// The channel is closed by Disconnect or when the connection is lost for good, after which a new one must be requested.
+func (f *Spyserver) IQChannel(bufferDepth int, policy spytypes.OverflowPolicy) <-chan spytypes.SampleBlock {
+	var c = spytypes.NewFrameChannel[spytypes.SampleBlock](bufferDepth, policy)
+	f.mtx.Lock()
+	f.iqChannels = append(f.iqChannels, c)
+	f.mtx.Unlock()
+	return c.C()
+}
+
+// FFTChannel returns a channel that receives the FFT frames, buffering up to bufferDepth frames.
+// It follows the same rules as IQChannel.
+func (f *Spyserver) FFTChannel(bufferDepth int, policy spytypes.OverflowPolicy) <-chan spytypes.FFTFrame {
+	var c = spytypes.NewFrameChannel[spytypes.FFTFrame](bufferDepth, policy)
+	f.mtx.Lock()
+	f.fftChannels = append(f.fftChannels, c)
+	f.mtx.Unlock()
+	return c.C()
+}
+
+// AFChannel returns a channel that receives the demodulated audio, buffering up to bufferDepth frames.
+// The audio is only sent in StreamModeAFOnly and StreamModeFFTAF. The server demodulates the IQ channel,
+// so the frames carry the IQ center frequency confirmed by the server. It follows the same rules as IQChannel.
+//
+// The audio format can't be chosen, the protocol has no setting for it: the server sends its own format,
+// which is decoded to float32 samples. The server doesn't report the audio sample rate either, so SampleRate is 0.
+func (f *Spyserver) AFChannel(bufferDepth int, policy spytypes.OverflowPolicy) <-chan spytypes.AudioFrame {
+	var c = spytypes.NewFrameChannel[spytypes.AudioFrame](bufferDepth, policy)
+	f.mtx.Lock()
+	f.afChannels = append(f.afChannels, c)
+	f.mtx.Unlock()
+	return c.C()
+}
+
+// SetCallback sets the legacy callback for server data. It is the same as SetHandler(spytypes.CallbackHandler(cb)).
+//
+// Deprecated: use SetHandler.
 func (f *Spyserver) SetCallback(cb spytypes.Callback) {
-	f.callback = cb
+	f.SetHandler(spytypes.CallbackHandler(cb))
 }
 
-// GetAvailableSampleRates returns a list of available sample rates for the current connection.
+// GetAvailableSampleRates returns a list of the IQ sample rates available for the current connection.
+// Use GetIQSampleRates and GetFFTSampleRates for the decimation stage and bandwidth of each rate.
 func (f *Spyserver) GetAvailableSampleRates() []uint32 {
-	return f.availableSampleRates
+	var rates = f.GetIQSampleRates()
+	var sampleRates = make([]uint32, len(rates))
+	for i, rate := range rates {
+		sampleRates[i] = rate.SampleRate
+	}
+	return sampleRates
 }
 
 // SetDisplaySampleRate sets the sample rate of the FFT Channel in Hertz
-// Check the available sample rates using GetAvailableSampleRates
-// Returns InvalidValue in case of a invalid value in the input
-func (f *Spyserver) SetDisplaySampleRate(sampleRate uint32) uint32 {
-	for i := uint32(0); i < f.deviceInfo.DecimationStageCount; i++ {
-		if f.availableSampleRates[i] == sampleRate {
-			f.displayDecimationStageCount = i
-			f.setSetting(settingFFTDecimation, []uint32{i})
-			f.currentDisplaySampleRate = sampleRate
-			return sampleRate
-		}
+// Check the available sample rates using GetFFTSampleRates
+// Returns ErrInvalidValue in case of a invalid value in the input
+func (f *Spyserver) SetDisplaySampleRate(sampleRate uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.setDisplaySampleRate(sampleRate)
+}
+
+func (f *Spyserver) setDisplaySampleRate(sampleRate uint32) error {
+	if !f.connected {
+		return ErrNotConnected
 	}
 
-	return InvalidValue
+	i, err := f.findStage(sampleRate, 0)
+	if err != nil {
+		return err
+	}
+
+	f.displayDecimationStageCount = i
+	if err := f.setSetting(SettingFFTDecimation, []uint32{i}); err != nil {
+		return err
+	}
+	f.currentDisplaySampleRate = sampleRate
+	return nil
 }
 
 // SetDisplayDecimationStage sets the sample rate of the FFT Channel by using the number of decimation stages.
 // Each decimation stage decimates by two, then the total decimation will be defined by 2^stages.
 // This is the same as SetSampleRate, but SetSampleRate instead, looks at a pre-filled table of all 2^stages
 // decimations that the server supports and applies into the original device sample rate.
-// Returns InvalidValue in case of a invalid value in the input
-func (f *Spyserver) SetDisplayDecimationStage(decimation uint32) uint32 {
-	if decimation > f.deviceInfo.DecimationStageCount {
-		return InvalidValue
+// Returns ErrInvalidValue in case of a invalid value in the input
+func (f *Spyserver) SetDisplayDecimationStage(decimation uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.connected {
+		return ErrNotConnected
+	}
+	if err := f.validFFTStage(decimation); err != nil {
+		return err
 	}
 	f.displayDecimationStageCount = decimation
-	f.setSetting(settingFFTDecimation, []uint32{decimation})
-	f.currentDisplaySampleRate = f.availableSampleRates[decimation]
+	if err := f.setSetting(SettingFFTDecimation, []uint32{decimation}); err != nil {
+		return err
+	}
+	f.currentDisplaySampleRate = f.sampleRates[decimation].SampleRate
 
-	return decimation
+	return nil
 }
 
 // GetDisplaySampleRate returns the sample rate of FFT Channel in Hertz
 func (f *Spyserver) GetDisplaySampleRate() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.currentDisplaySampleRate
 }
 
 // GetDisplayBandwidth returns the effective bandwidth of the FFT Channel in Hertz.
 // For calculating the frequency of each FFT Pixel Column, you should use this as total FFT Bandwidth.
 func (f *Spyserver) GetDisplayBandwidth() uint32 {
-	return uint32(float32(f.currentDisplaySampleRate) * 0.8)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.displayDecimationStageCount >= uint32(len(f.sampleRates)) {
+		return 0
+	}
+	return f.sampleRates[f.displayDecimationStageCount].Bandwidth
 }
 
-// SetGain sets the gain stage of the server.
+// SetGain sets the gain stage of the server, from 0 to the MaximumGainIndex of the device.
 // The actual gain in dB varies from device to device.
-// Returns InvalidValue in case of a invalid value in the input
-func (f *Spyserver) SetGain(gain uint32) uint32 {
-	if gain > f.deviceInfo.GainStageCount {
-		return InvalidValue
+// Returns ErrInvalidValue in case of a invalid value in the input
+func (f *Spyserver) SetGain(gain uint32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.connected {
+		return ErrNotConnected
+	}
+
+	return f.setGain(gain)
+}
+
+// setGain sets the gain index. Must be called with mtx held.
+func (f *Spyserver) setGain(gain uint32) error {
+	if gain > f.deviceInfo.MaximumGainIndex {
+		return ErrInvalidValue
+	}
+	if err := f.setSetting(SettingGain, []uint32{gain}); err != nil {
+		return err
 	}
-	f.setSetting(settingGain, []uint32{gain})
 	f.gain = gain
 
-	return gain
+	return nil
 }
 
 // GetGain returns the current gain stage of the server.
 func (f *Spyserver) GetGain() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	return f.gain
 }
 
@@ -0,0 +1,1465 @@
+package spyserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/racerxdl/spy2go/spyserver/spyservertest"
+	"github.com/racerxdl/spy2go/spytypes"
+)
+
+// recordingCallback counts the events received from Spyserver
+type recordingCallback struct {
+	mtx    sync.Mutex
+	counts map[int]int
+	events chan int
+}
+
+func newRecordingCallback() *recordingCallback {
+	return &recordingCallback{
+		counts: map[int]int{},
+		events: make(chan int, 1024),
+	}
+}
+
+func (cb *recordingCallback) OnData(dType int, data interface{}) {
+	cb.mtx.Lock()
+	cb.counts[dType]++
+	cb.mtx.Unlock()
+
+	select {
+	case cb.events <- dType:
+	default:
+	}
+}
+
+func (cb *recordingCallback) Count(dType int) int {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	return cb.counts[dType]
+}
+
+// WaitFor waits until the callback receives an event of the given type
+func (cb *recordingCallback) WaitFor(t *testing.T, dType int) {
+	t.Helper()
+	var timeout = time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-cb.events:
+			if ev == dType {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for event %d", dType)
+		}
+	}
+}
+
+// fakeServer is a spyservertest.Server that fails the test on timeouts
+type fakeServer struct {
+	*spyservertest.Server
+	t *testing.T
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	var s = spyservertest.NewServer()
+	t.Cleanup(s.Close)
+	return &fakeServer{Server: s, t: t}
+}
+
+// expectSetting waits until the server receives the setting with the given value
+func (s *fakeServer) expectSetting(setting, value uint32) {
+	s.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.WaitSetting(ctx, setting, value); err != nil {
+		s.t.Fatalf("server didn't receive setting %d = %d", setting, value)
+	}
+}
+
+func connectToFake(t *testing.T, server *fakeServer) *Spyserver {
+	t.Helper()
+	var s = MakeSpyserverByFullHS(server.Addr)
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Disconnect)
+	return s
+}
+
+func TestConnect(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if !s.IsConnected() {
+		t.Fatal("expected to be connected")
+	}
+	if !s.CanControl() {
+		t.Fatal("expected to be able to control the device")
+	}
+	if s.GetName() != DeviceAirspyOneName {
+		t.Fatalf("unexpected device name %q", s.GetName())
+	}
+	if len(s.GetAvailableSampleRates()) != 8 {
+		t.Fatalf("expected 8 sample rates, got %d", len(s.GetAvailableSampleRates()))
+	}
+
+	server.expectSetting(SettingIqFormat, StreamFormatInt16)
+
+	s.Disconnect()
+	if s.IsConnected() {
+		t.Fatal("expected to be disconnected")
+	}
+	if s.Err() != nil {
+		t.Fatalf("unexpected error after Disconnect: %s", s.Err())
+	}
+}
+
+func TestConnectNoDevice(t *testing.T) {
+	var server = newFakeServer(t)
+	server.UpdateDeviceInfo(func(info *DeviceInfo) { info.DeviceType = DeviceInvalid })
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	if err := s.Connect(); !errors.Is(err, ErrNoDevice) {
+		t.Fatalf("expected ErrNoDevice, got %v", err)
+	}
+	if s.IsConnected() {
+		t.Fatal("expected to be disconnected")
+	}
+}
+
+func TestConnectHandshakeTimeout(t *testing.T) {
+	var server = newFakeServer(t)
+	server.SetSilent(true)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	s.SetHandshakeTimeout(50 * time.Millisecond)
+
+	if err := s.Connect(); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("expected ErrHandshakeTimeout, got %v", err)
+	}
+}
+
+func TestConnectContextCancel(t *testing.T) {
+	var server = newFakeServer(t)
+	server.SetSilent(true)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	if err := s.ConnectContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestConnectProtocolVersion(t *testing.T) {
+	var server = newFakeServer(t)
+	server.SetProtocolVersion(3 << 24)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	err := s.Connect()
+	if !errors.Is(err, ErrProtocolVersion) {
+		t.Fatalf("expected ErrProtocolVersion, got %v", err)
+	}
+
+	var versionErr *ProtocolVersionError
+	if !errors.As(err, &versionErr) || versionErr.Server != 3<<24 {
+		t.Fatalf("expected a ProtocolVersionError, got %v", err)
+	}
+}
+
+func TestSettersNotConnected(t *testing.T) {
+	var s = MakeSpyserver("127.0.0.1", 5555)
+
+	if err := s.SetGain(1); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	if err := s.SetSampleRate(1000000); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	if err := s.SetCenterFrequency(100000000); err != nil {
+		t.Fatalf("expected the frequency to be cached, got %v", err)
+	}
+	if err := s.SetStreamingMode(42); err != ErrInvalidValue {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+}
+
+func TestSettersValidation(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetGain(22); err != ErrInvalidValue {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if err := s.SetDecimationStage(8); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if err := s.SetSampleRate(1234); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if err := s.SetSampleRate(2500000); err != nil {
+		t.Fatal(err)
+	}
+	server.expectSetting(SettingIqDecimation, 2)
+}
+
+func TestRun(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if cb.Count(spytypes.SamplesComplex32) == 0 {
+		t.Fatal("expected to receive IQ samples")
+	}
+	if s.IsStreaming() {
+		t.Fatal("expected the streaming to be stopped")
+	}
+	server.expectSetting(SettingStreamingEnabled, 0)
+}
+
+func TestConnectionLost(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+
+	server.DropConnections()
+	cb.WaitFor(t, spytypes.Error)
+
+	if s.IsConnected() {
+		t.Fatal("expected to be disconnected")
+	}
+	if s.Err() == nil {
+		t.Fatal("expected Err to report the lost connection")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = MakeSpyserverByFullHS(server.Addr)
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+	s.SetReconnectPolicy(&ReconnectPolicy{InitialBackoff: 10 * time.Millisecond})
+
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	if err := s.SetCenterFrequency(106300000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetGain(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	server.expectSetting(SettingStreamingEnabled, 1)
+
+	var before = len(server.Commands())
+	server.DropConnections()
+
+	cb.WaitFor(t, spytypes.Reconnecting)
+	cb.WaitFor(t, spytypes.Reconnected)
+
+	if !s.IsConnected() || !s.IsStreaming() {
+		t.Fatal("expected the connection and streaming to be restored")
+	}
+	if s.Reconnects() != 1 {
+		t.Fatalf("expected one reconnect, got %d", s.Reconnects())
+	}
+
+	// The streaming state is the last replayed setting
+	var replayed map[uint32]uint32
+	var deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		replayed = map[uint32]uint32{}
+		for _, cmd := range server.Commands()[before:] {
+			if cmd.Type == cmdSetSetting {
+				replayed[cmd.Setting] = cmd.Value
+			}
+		}
+		if _, ok := replayed[SettingStreamingEnabled]; ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var expected = map[uint32]uint32{
+		SettingIqFrequency:      106300000,
+		SettingGain:             10,
+		SettingStreamingEnabled: 1,
+		SettingStreamingMode:    StreamModeIQOnly,
+		SettingFFTDisplayPixels: defaultDisplayPixels,
+	}
+	for setting, value := range expected {
+		if replayed[setting] != value {
+			t.Errorf("setting %d: expected %d to be replayed, got %d", setting, value, replayed[setting])
+		}
+	}
+}
+
+func TestDisconnectWhileReconnecting(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+	s.SetReconnectPolicy(&ReconnectPolicy{InitialBackoff: time.Hour})
+
+	server.DropConnections()
+	cb.WaitFor(t, spytypes.Reconnecting)
+
+	var disconnected = make(chan struct{})
+	go func() {
+		s.Disconnect()
+		close(disconnected)
+	}()
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Disconnect didn't interrupt the reconnect backoff")
+	}
+
+	if s.Err() != nil {
+		t.Fatalf("unexpected error: %s", s.Err())
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+	s.SetCallback(newRecordingCallback())
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.SetCenterFrequency(uint32(100000000 + i*1000 + j))
+				s.SetGain(uint32(j % 21))
+				s.SetDisplayPixels(uint32(1000 + j))
+				s.GetCenterFrequency()
+				s.GetDeviceCenterFrequency()
+				s.GetGain()
+				s.CanControl()
+				s.IsStreaming()
+				s.IsConnected()
+				s.GetDroppedBuffers()
+				s.GetAvailableSampleRates()
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			s.SetCallback(newRecordingCallback())
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	wg.Wait()
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	var samples = make(chan []spytypes.ComplexInt16, 16)
+	s.SetHandler(spytypes.Handler{
+		OnInt16IQ: func(data []spytypes.ComplexInt16) {
+			select {
+			case samples <- data:
+			default:
+			}
+		},
+	})
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case data := <-samples:
+		if len(data) != 256 {
+			t.Fatalf("expected 256 samples, got %d", len(data))
+		}
+		if data[1] != (spytypes.ComplexInt16{Real: 2, Imag: 3}) {
+			t.Fatalf("unexpected sample %v", data[1])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for IQ samples")
+	}
+}
+
+func TestIQChannel(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	var iq = s.IQChannel(4, spytypes.OverflowDropOldest)
+	var blocking = s.IQChannel(1, spytypes.OverflowBlock)
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case block := <-iq:
+		if len(block.ComplexInt16) != 256 {
+			t.Fatalf("expected 256 samples, got %d", len(block.ComplexInt16))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for IQ samples")
+	}
+
+	// The blocking channel is never drained, so the reader is stalled until Disconnect closes it
+	var disconnected = make(chan struct{})
+	go func() {
+		s.Disconnect()
+		close(disconnected)
+	}()
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Disconnect didn't unblock the reader")
+	}
+
+	for range iq {
+	}
+	for range blocking {
+	}
+}
+
+func TestSampleBlockMetadata(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetCenterFrequency(106300000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSampleRate(2500000); err != nil {
+		t.Fatal(err)
+	}
+
+	var iq = s.IQChannel(64, spytypes.OverflowDropNewest)
+	var start = time.Now()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var first, second spytypes.SampleBlock
+	for _, block := range []*spytypes.SampleBlock{&first, &second} {
+		select {
+		case *block = <-iq:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for IQ samples")
+		}
+	}
+
+	if first.StreamType != StreamTypeIQ || first.MessageType != msgTypeInt16IQ {
+		t.Fatalf("unexpected stream %d / message %d", first.StreamType, first.MessageType)
+	}
+	if first.CenterFrequency != 106300000 || first.SampleRate != 2500000 || first.DecimationStage != 2 {
+		t.Fatalf("unexpected parameters %d Hz / %d sps / stage %d", first.CenterFrequency, first.SampleRate, first.DecimationStage)
+	}
+	if first.Timestamp.Before(start) {
+		t.Fatal("expected the timestamp to be set on receive")
+	}
+	if second.SequenceNumber != first.SequenceNumber+1 {
+		t.Fatalf("expected consecutive sequence numbers, got %d and %d", first.SequenceNumber, second.SequenceNumber)
+	}
+	if second.SampleIndex != first.SampleIndex+uint64(len(first.ComplexInt16)) {
+		t.Fatalf("expected sample index %d, got %d", first.SampleIndex+uint64(len(first.ComplexInt16)), second.SampleIndex)
+	}
+}
+
+func TestInt24IQ(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetIQFormat(42); err != ErrInvalidValue {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if err := s.SetIQFormat(StreamFormatInt24); err != nil {
+		t.Fatal(err)
+	}
+	server.expectSetting(SettingIqFormat, StreamFormatInt24)
+
+	var iq = s.IQChannel(4, spytypes.OverflowDropNewest)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case block := <-iq:
+		if block.MessageType != msgTypeInt24IQ || len(block.ComplexInt32) != 256 {
+			t.Fatalf("expected 256 Int24 samples, got message %d with %d samples", block.MessageType, len(block.ComplexInt32))
+		}
+		if block.ComplexInt32[0] != (spytypes.ComplexInt32{Real: -256000, Imag: -255000}) {
+			t.Fatalf("unexpected sample %v", block.ComplexInt32[0])
+		}
+		if block.ComplexInt32[255] != (spytypes.ComplexInt32{Real: 254000, Imag: 255000}) {
+			t.Fatalf("unexpected sample %v", block.ComplexInt32[255])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for IQ samples")
+	}
+}
+
+func TestIQFormats(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if s.GetIQFormat() != StreamFormatInt16 {
+		t.Fatalf("expected Int16 as the default format, got %d", s.GetIQFormat())
+	}
+
+	var check = map[uint32]func(block spytypes.SampleBlock) bool{
+		StreamFormatUint8: func(block spytypes.SampleBlock) bool {
+			return len(block.ComplexUInt8) == 256 && block.ComplexUInt8[1] == spytypes.ComplexUInt8{Real: 2, Imag: 3}
+		},
+		StreamFormatFloat: func(block spytypes.SampleBlock) bool {
+			return len(block.Complex64) == 256 && block.Complex64[1] == complex(2, 3)
+		},
+		StreamFormatInt16: func(block spytypes.SampleBlock) bool {
+			return len(block.ComplexInt16) == 256 && block.ComplexInt16[1] == spytypes.ComplexInt16{Real: 2, Imag: 3}
+		},
+	}
+
+	for format, ok := range check {
+		if err := s.SetIQFormat(format); err != nil {
+			t.Fatal(err)
+		}
+		server.expectSetting(SettingIqFormat, format)
+		if s.GetIQFormat() != format {
+			t.Fatalf("expected format %d, got %d", format, s.GetIQFormat())
+		}
+
+		var iq = s.IQChannel(1, spytypes.OverflowDropNewest)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case block := <-iq:
+			if !ok(block) {
+				t.Fatalf("format %d: unexpected block %+v", format, block)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("format %d: timeout waiting for IQ samples", format)
+		}
+
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		server.expectSetting(SettingStreamingEnabled, 0)
+	}
+}
+
+func TestForcedIQFormat(t *testing.T) {
+	var server = newFakeServer(t)
+	server.UpdateDeviceInfo(func(info *DeviceInfo) { info.ForcedIQFormat = StreamFormatUint8 })
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	if err := s.SetIQFormat(StreamFormatFloat); err != nil {
+		t.Fatalf("expected the format to be cached, got %v", err)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	if s.GetIQFormat() != StreamFormatUint8 {
+		t.Fatalf("expected the forced format, got %d", s.GetIQFormat())
+	}
+	server.expectSetting(SettingIqFormat, StreamFormatUint8)
+
+	if err := s.SetIQFormat(StreamFormatInt16); err != ErrInvalidValue {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+}
+
+func TestFFTFormats(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetFFTFormat(StreamFormatInt16); err != ErrInvalidValue {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if err := s.SetStreamingMode(StreamModeFFTOnly); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected = []uint32{msgTypeUint8FFT, msgTypeDint4FFT, msgTypeCompressedFFT}
+	for i, format := range []uint32{StreamFormatUint8, StreamFormatDint4, StreamFormatCompressed} {
+		if err := s.SetFFTFormat(format); err != nil {
+			t.Fatal(err)
+		}
+		server.expectSetting(SettingFFTFormat, format)
+		if s.GetFFTFormat() != format {
+			t.Fatalf("expected format %d, got %d", format, s.GetFFTFormat())
+		}
+
+		var fft = s.FFTChannel(1, spytypes.OverflowDropNewest)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case frame := <-fft:
+			if frame.MessageType != expected[i] || frame.StreamType != StreamTypeFFT {
+				t.Fatalf("format %d: unexpected message %d on stream %d", format, frame.MessageType, frame.StreamType)
+			}
+			if len(frame.Bins) != 256 || frame.Bins[17] != 0x11 || frame.Bins[31] != 0xFF {
+				t.Fatalf("format %d: unexpected bins %v", format, frame.Bins)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("format %d: timeout waiting for FFT frames", format)
+		}
+
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		server.expectSetting(SettingStreamingEnabled, 0)
+	}
+}
+
+func TestCompressedFFTMalformedFrame(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+	var fft = s.FFTChannel(4, spytypes.OverflowDropNewest)
+
+	// A bad frame is dropped, the next one is delivered
+	if err := server.Send(msgTypeCompressedFFT, StreamTypeFFT, []uint8{0xFF, 0xFF, 0xFF}); err != nil {
+		t.Fatal(err)
+	}
+	var msgType, body = spyservertest.FFTMessage(StreamFormatCompressed)
+	if err := server.Send(msgType, StreamTypeFFT, body); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case frame := <-fft:
+		if frame.MessageType != msgTypeCompressedFFT || !bytes.Equal(frame.Bins, spyservertest.FFTBins()) {
+			t.Fatalf("unexpected frame %d with bins %v", frame.MessageType, frame.Bins)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for FFT frames")
+	}
+	if stats := s.Stats(); stats.DecodeErrors != 1 || stats.FFT.Frames != 2 {
+		t.Fatalf("expected one of two frames dropped, got %d decode errors in %d frames", stats.DecodeErrors, stats.FFT.Frames)
+	}
+}
+
+func TestDecodeCompressedFFTMalformed(t *testing.T) {
+	if _, err := decodeCompressedFFT([]uint8{0xFF, 0xFF, 0xFF}); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("expected ErrMalformedMessage, got %v", err)
+	}
+}
+
+func TestAudio(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetStreamingMode(StreamModeAFOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSampleRate(5000000); err != nil {
+		t.Fatal(err)
+	}
+	// Clamped by the server to the maximum IQ center frequency
+	if err := s.SetCenterFrequency(2000000000); err != nil {
+		t.Fatal(err)
+	}
+
+	var af = s.AFChannel(1, spytypes.OverflowDropNewest)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case frame := <-af:
+		if frame.MessageType != msgTypeInt16AF || len(frame.Samples) != 256 {
+			t.Fatalf("unexpected message %d with %d samples", frame.MessageType, len(frame.Samples))
+		}
+		if frame.Samples[128] != 0.25 {
+			t.Fatalf("expected sample 128 to be 0.25, got %f", frame.Samples[128])
+		}
+		if frame.SampleRate != 0 {
+			t.Fatalf("expected the audio sample rate to be unknown, got %d", frame.SampleRate)
+		}
+		if frame.CenterFrequency != 1800000000 {
+			t.Fatalf("expected the confirmed center frequency, got %d", frame.CenterFrequency)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for audio")
+	}
+}
+
+func TestDecodeAudio(t *testing.T) {
+	var cases = []struct {
+		msgType  uint32
+		body     []uint8
+		expected []float32
+	}{
+		{msgTypeUint8AF, []uint8{0, 128, 192}, []float32{-1, 0, 0.5}},
+		{msgTypeInt16AF, []uint8{0x00, 0x80, 0x00, 0x40}, []float32{-1, 0.5}},
+		{msgTypeInt24AF, []uint8{0x00, 0x00, 0xC0, 0x00, 0x00, 0x40}, []float32{-0.5, 0.5}},
+		{msgTypeFloatAF, []uint8{0x00, 0x00, 0x80, 0x3E}, []float32{0.25}},
+	}
+
+	for _, c := range cases {
+		samples, err := decodeAudio(c.msgType, c.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != len(c.expected) {
+			t.Fatalf("message %d: expected %v, got %v", c.msgType, c.expected, samples)
+		}
+		for i := range samples {
+			if samples[i] != c.expected[i] {
+				t.Fatalf("message %d: expected %v, got %v", c.msgType, c.expected, samples)
+			}
+		}
+	}
+
+	if _, err := decodeAudio(msgTypeCompressedAF, []uint8{1, 2}); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("expected ErrMalformedMessage, got %v", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = MakeSpyserverByFullHS(server.Addr)
+	s.SetKeepalive(5*time.Millisecond, time.Second)
+
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	var deadline = time.Now().Add(2 * time.Second)
+	for s.Latency().Count < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for pongs")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var latency = s.Latency()
+	if latency.Min <= 0 || latency.Min > latency.Avg || latency.Avg > latency.Max || latency.Last > latency.Max {
+		t.Fatalf("inconsistent latency stats %+v", latency)
+	}
+}
+
+func TestBarrierPingsLatency(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetDecimationStage(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Apply(context.Background(), Change{Setting: SettingGain, Value: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both pongs arrived, Apply waits for the last one
+	if latency := s.Latency(); latency.Count != 0 {
+		t.Fatalf("expected no keepalive latency, got %+v", latency)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	var server = newFakeServer(t)
+	server.IgnorePings(true)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+	s.SetKeepalive(5*time.Millisecond, 20*time.Millisecond)
+
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	cb.WaitFor(t, spytypes.Error)
+
+	if !errors.Is(s.Err(), ErrKeepaliveTimeout) {
+		t.Fatalf("expected ErrKeepaliveTimeout, got %v", s.Err())
+	}
+}
+
+func TestGetSettingFromServer(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetGain(10); err != nil {
+		t.Fatal(err)
+	}
+	server.expectSetting(SettingGain, 10)
+
+	// Another client changes the settings
+	server.SetValue(SettingGain, 5)
+	server.SetValue(SettingIqFrequency, 99000000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	gain, err := s.GetSettingFromServer(ctx, SettingGain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gain != 5 {
+		t.Fatalf("expected gain 5, got %d", gain)
+	}
+	if s.GetGain() != 10 {
+		t.Fatalf("expected the cached gain to be kept, got %d", s.GetGain())
+	}
+
+	if err := s.Refresh(ctx, SettingGain, SettingIqFrequency); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetGain() != 5 || s.GetCenterFrequency() != 99000000 {
+		t.Fatalf("expected the refreshed values, got gain %d and frequency %d", s.GetGain(), s.GetCenterFrequency())
+	}
+
+	if err := s.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetSettingFromServerConnectionLost(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if _, err := MakeSpyserverByFullHS(server.Addr).GetSettingFromServer(context.Background(), SettingGain); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+
+	server.IgnoreReads(true)
+
+	var result = make(chan error, 1)
+	go func() {
+		_, err := s.GetSettingFromServer(context.Background(), SettingGain)
+		result <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	server.DropConnections()
+
+	select {
+	case err := <-result:
+		if err != ErrNotConnected {
+			t.Fatalf("expected ErrNotConnected, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("GetSettingFromServer didn't return after the connection was lost")
+	}
+}
+
+func TestDeviceInfoAndLastSync(t *testing.T) {
+	var server = newFakeServer(t)
+	server.UpdateDeviceInfo(func(info *DeviceInfo) { info.ForcedIQFormat = StreamFormatInt16 })
+	var s = connectToFake(t, server)
+
+	var info = s.DeviceInfo()
+	if info.DeviceType != DeviceAirspyOne || info.DeviceSerial != 0x1234 || info.Resolution != 12 ||
+		info.MaximumBandwidth != 8000000 || info.GainStageCount != 21 || info.ForcedIQFormat != StreamFormatInt16 {
+		t.Fatalf("unexpected device info %+v", info)
+	}
+
+	if s.LastSync().CanControl != 1 {
+		t.Fatalf("unexpected client sync %+v", s.LastSync())
+	}
+
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+	if err := s.SetCenterFrequency(106300000); err != nil {
+		t.Fatal(err)
+	}
+	cb.WaitFor(t, spytypes.DeviceSync)
+
+	if sync := s.LastSync(); sync.IQCenterFrequency != 106300000 || sync.DeviceCenterFrequency != 106300000 {
+		t.Fatalf("expected the new frequency in the client sync, got %+v", sync)
+	}
+
+	s.Disconnect()
+	if s.DeviceInfo() != (DeviceInfo{}) || s.LastSync() != (ClientSync{}) {
+		t.Fatal("expected the device info and client sync to be cleared on Disconnect")
+	}
+}
+
+func TestSampleRates(t *testing.T) {
+	var server = newFakeServer(t)
+	server.UpdateDeviceInfo(func(info *DeviceInfo) { info.MinimumIQDecimation = 2 })
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	if len(s.GetIQSampleRates()) != 0 {
+		t.Fatal("expected no sample rates before connecting")
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	var iq = s.GetIQSampleRates()
+	if len(iq) != 6 || iq[0] != (SampleRate{DecimationStage: 2, SampleRate: 2500000, Bandwidth: 2000000}) {
+		t.Fatalf("unexpected IQ sample rates %+v", iq)
+	}
+	if len(s.GetAvailableSampleRates()) != 6 || s.GetAvailableSampleRates()[0] != 2500000 {
+		t.Fatalf("unexpected available sample rates %v", s.GetAvailableSampleRates())
+	}
+
+	var fft = s.GetFFTSampleRates()
+	if len(fft) != 8 || fft[0] != (SampleRate{DecimationStage: 0, SampleRate: 10000000, Bandwidth: 8000000}) {
+		t.Fatalf("unexpected FFT sample rates %+v", fft)
+	}
+
+	if err := s.SetSampleRate(5000000); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if err := s.SetDecimationStage(1); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if err := s.SetDisplaySampleRate(5000000); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetDisplayBandwidth() != 4000000 {
+		t.Fatalf("unexpected display bandwidth %d", s.GetDisplayBandwidth())
+	}
+
+	if err := s.SetDecimationStage(3); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetSampleRate() != 1250000 || s.GetBandwidth() != 1000000 {
+		t.Fatalf("unexpected sample rate %d and bandwidth %d", s.GetSampleRate(), s.GetBandwidth())
+	}
+}
+
+func TestSampleRatesInvalidDevice(t *testing.T) {
+	var rates = buildSampleRates(DeviceInfo{MaximumSampleRate: 10000000, DecimationStageCount: math.MaxUint32})
+	if len(rates) != maxDecimationStages || rates[31].SampleRate != 0 {
+		t.Fatalf("expected the stages to be capped, got %d", len(rates))
+	}
+
+	var server = newFakeServer(t)
+	var s = MakeSpyserverByFullHS(server.Addr)
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+	s.SetReconnectPolicy(&ReconnectPolicy{InitialBackoff: 10 * time.Millisecond})
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+	if err := s.SetDecimationStage(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither the replayed stage nor the minimum one exist on the new device
+	server.UpdateDeviceInfo(func(info *DeviceInfo) {
+		info.DecimationStageCount = 2
+		info.MinimumIQDecimation = 5
+	})
+	server.DropConnections()
+	cb.WaitFor(t, spytypes.Reconnected)
+
+	if s.GetSampleRate() != 0 {
+		t.Fatalf("expected no sample rate, got %d", s.GetSampleRate())
+	}
+}
+
+func TestGainDB(t *testing.T) {
+	var server = newFakeServer(t)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	if len(s.GetGainSteps()) != 0 {
+		t.Fatal("expected no gain steps before connecting")
+	}
+	if err := s.SetGainDB(10); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	var steps = s.GetGainSteps()
+	if len(steps) != 22 || steps[21] != (GainStep{Index: 21, DB: 42}) {
+		t.Fatalf("unexpected gain steps %+v", steps)
+	}
+
+	if err := s.SetGainDB(12.9); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetGain() != 6 || s.GetGainDB() != 12 {
+		t.Fatalf("unexpected gain %d (%f dB)", s.GetGain(), s.GetGainDB())
+	}
+	server.expectSetting(SettingGain, 6)
+
+	if err := s.SetGainDB(100); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetGain() != 21 {
+		t.Fatalf("expected the maximum gain, got %d", s.GetGain())
+	}
+
+	// The table is copied and only changes this client
+	var table = DefaultGainTable(DeviceAirspyOne)
+	for i := range table {
+		table[i] += 3
+	}
+	s.SetGainTable(DeviceAirspyOne, table)
+	table[21] = 0
+	if s.GetGainDB() != 45 {
+		t.Fatalf("expected the adjusted gain table, got %f dB", s.GetGainDB())
+	}
+	if DefaultGainTable(DeviceAirspyOne)[21] != 42 {
+		t.Fatal("expected the default gain table to be unchanged")
+	}
+	var other = connectToFake(t, server)
+	if err := other.SetGain(21); err != nil {
+		t.Fatal(err)
+	}
+	if other.GetGainDB() != 42 {
+		t.Fatalf("expected the default gain table on another client, got %f dB", other.GetGainDB())
+	}
+
+	s.SetGainTable(DeviceAirspyOne, nil)
+	if s.GetGainDB() != 21 {
+		t.Fatalf("expected one dB per index without a table, got %f dB", s.GetGainDB())
+	}
+}
+
+func TestGainMaximumIndex(t *testing.T) {
+	var server = newFakeServer(t)
+	server.UpdateDeviceInfo(func(info *DeviceInfo) {
+		info.GainStageCount = 22
+		info.MaximumGainIndex = 21
+	})
+	var s = connectToFake(t, server)
+
+	if steps := s.GetGainSteps(); len(steps) != 22 {
+		t.Fatalf("expected 22 gain steps, got %d", len(steps))
+	}
+	if err := s.SetGain(22); err != ErrInvalidValue {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if _, err := s.Apply(context.Background(), Change{Setting: SettingGain, Value: 22}); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue from Apply, got %v", err)
+	}
+	if err := s.SetGain(21); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	var server = newFakeServer(t)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	if _, err := s.Apply(context.Background(), Change{SettingGain, 5}); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	sync, err := s.Apply(ctx, Change{SettingGain, 5}, Change{SettingIqFrequency, 100000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync.Gain != 5 || sync.IQCenterFrequency != 100000000 {
+		t.Fatalf("unexpected sync %+v", sync)
+	}
+	if s.GetGain() != 5 || s.GetCenterFrequency() != 100000000 {
+		t.Fatalf("unexpected gain %d and frequency %d", s.GetGain(), s.GetCenterFrequency())
+	}
+
+	_, err = s.Apply(ctx, Change{SettingIqFrequency, 2000000000})
+	var applyErr *ApplyError
+	if !errors.As(err, &applyErr) || !errors.Is(err, ErrNotApplied) {
+		t.Fatalf("expected an ApplyError, got %v", err)
+	}
+	if len(applyErr.Settings) != 1 || applyErr.Settings[0] != (SettingMismatch{SettingIqFrequency, 2000000000, 1800000000, false}) {
+		t.Fatalf("unexpected mismatches %+v", applyErr.Settings)
+	}
+	if s.GetCenterFrequency() != 1800000000 {
+		t.Fatalf("expected the clamped frequency, got %d", s.GetCenterFrequency())
+	}
+
+	if _, err := s.Apply(ctx, Change{SettingGain, 50}); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+}
+
+func TestApplyNoControl(t *testing.T) {
+	var server = newFakeServer(t)
+	server.RefuseControl(true)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// The FFT frequency doesn't need control, the gain is refused
+	sync, err := s.Apply(ctx, Change{SettingFFTFrequency, 100000000}, Change{SettingGain, 5})
+	if !errors.Is(err, ErrNoControl) {
+		t.Fatalf("expected ErrNoControl, got %v", err)
+	}
+	var applyErr *ApplyError
+	if !errors.As(err, &applyErr) || len(applyErr.Settings) != 1 || applyErr.Settings[0] != (SettingMismatch{SettingGain, 5, 0, true}) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if sync.FFTCenterFrequency != 100000000 {
+		t.Fatalf("expected the FFT frequency to be applied, got %+v", sync)
+	}
+	if v, ok := server.LastSetting(SettingGain); !ok || v != 5 {
+		t.Fatal("expected the gain to be sent")
+	}
+}
+
+func TestApplyValidation(t *testing.T) {
+	var server = newFakeServer(t)
+	server.UpdateDeviceInfo(func(info *DeviceInfo) { info.ForcedIQFormat = StreamFormatInt16 })
+	var s = connectToFake(t, server)
+
+	for _, c := range []Change{
+		{SettingStreamingMode, StreamTypeIQ | StreamTypeAF},
+		{SettingIqFormat, StreamFormatCompressed},
+		{SettingIqFormat, StreamFormatFloat},
+		{SettingFFTFormat, StreamFormatInt16},
+	} {
+		if _, err := s.Apply(context.Background(), c); !errors.Is(err, ErrInvalidValue) {
+			t.Fatalf("%+v: expected ErrInvalidValue, got %v", c, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := s.Apply(ctx, Change{SettingIqFormat, StreamFormatInt16}, Change{SettingStreamingMode, StreamModeFFTIQ}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetuneMarker(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := s.SetCenterFrequency(100000000); err != nil {
+		t.Fatal(err)
+	}
+	var iq = s.IQChannel(1024, spytypes.OverflowDropNewest)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var next = func() spytypes.SampleBlock {
+		t.Helper()
+		select {
+		case block := <-iq:
+			return block
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for IQ samples")
+		}
+		return spytypes.SampleBlock{}
+	}
+
+	// waitRetune reads until the marker, checking that no block has the new parameters before it
+	var waitRetune = func(frequency, sampleRate uint32) {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			var block = next()
+			var updated = block.CenterFrequency == frequency && block.SampleRate == sampleRate
+			if block.Retuned {
+				if !updated {
+					t.Fatalf("unexpected parameters on the marker %d Hz / %d sps", block.CenterFrequency, block.SampleRate)
+				}
+				break
+			}
+			if updated {
+				t.Fatal("got the new parameters before the marker")
+			}
+		}
+		for i := 0; i < 5; i++ {
+			var block = next()
+			if block.Retuned || block.CenterFrequency != frequency || block.SampleRate != sampleRate {
+				t.Fatalf("unexpected block after the marker: retuned %v, %d Hz / %d sps", block.Retuned, block.CenterFrequency, block.SampleRate)
+			}
+		}
+	}
+
+	var first = next()
+	if !first.Retuned || first.CenterFrequency != 100000000 {
+		t.Fatalf("expected the first block to be marked: retuned %v, %d Hz", first.Retuned, first.CenterFrequency)
+	}
+
+	if err := s.SetCenterFrequency(200000000); err != nil {
+		t.Fatal(err)
+	}
+	waitRetune(200000000, first.SampleRate)
+
+	if err := s.SetDecimationStage(3); err != nil {
+		t.Fatal(err)
+	}
+	waitRetune(200000000, 1250000)
+}
+
+func TestSyncEvents(t *testing.T) {
+	var server = newFakeServer(t)
+	var events = make(chan spytypes.DeviceSyncEvent, 16)
+	var control = make(chan string, 16)
+
+	var s = MakeSpyserverByFullHS(server.Addr)
+	s.SetHandler(spytypes.Handler{
+		OnSyncEvent:       func(e spytypes.DeviceSyncEvent) { events <- e },
+		OnControlLost:     func() { control <- "lost" },
+		OnControlRegained: func() { control <- "regained" },
+	})
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	var next = func() spytypes.DeviceSyncEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for the sync event")
+		}
+		return spytypes.DeviceSyncEvent{}
+	}
+
+	var first = next()
+	if !first.First || !first.New.CanControl || first.New.MaximumIQCenterFrequency != 1800000000 {
+		t.Fatalf("unexpected first event %+v", first)
+	}
+
+	if err := s.SetGain(3); err != nil {
+		t.Fatal(err)
+	}
+	var gain = next()
+	if gain.First || !gain.GainChanged() || gain.Old.Gain != 0 || gain.New.Gain != 3 || gain.FrequencyChanged() {
+		t.Fatalf("unexpected gain event %+v", gain)
+	}
+
+	server.UpdateSync(func(sync *ClientSync) {
+		sync.CanControl = 0
+		sync.IQCenterFrequency = 433000000
+	})
+	var lost = next()
+	if !lost.ControlLost() || !lost.FrequencyChanged() || lost.New.IQCenterFrequency != 433000000 {
+		t.Fatalf("unexpected event %+v", lost)
+	}
+	if c := <-control; c != "lost" {
+		t.Fatalf("expected control lost, got %s", c)
+	}
+
+	server.UpdateSync(func(sync *ClientSync) { sync.CanControl = 1 })
+	if e := next(); !e.ControlRegained() || !e.Changed() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	if c := <-control; c != "regained" {
+		t.Fatalf("expected control regained, got %s", c)
+	}
+}
+
+func TestStats(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	var iq = s.IQChannel(1024, spytypes.OverflowDropNewest)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var receive = func(count int) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			select {
+			case <-iq:
+			case <-time.After(2 * time.Second):
+				t.Fatal("timeout waiting for IQ samples")
+			}
+		}
+	}
+
+	receive(5)
+	server.SkipSequence(StreamTypeIQ, 5)
+	receive(5)
+
+	if err := server.Send(msgTypeCompressedFFT, StreamTypeFFT, []uint8{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Send(999, 0, []uint8{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	var deadline = time.Now().Add(2 * time.Second)
+	for s.Stats().UnsupportedMessages == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	var stats = s.Stats()
+	if stats.IQ.DroppedFrames != 5 || stats.IQ.Gaps != 1 || s.GetDroppedBuffers() != 5 {
+		t.Fatalf("expected one gap of 5 frames, got %d frames in %d gaps", stats.IQ.DroppedFrames, stats.IQ.Gaps)
+	}
+	if stats.IQ.Frames < 10 || stats.MessagesByType[msgTypeInt16IQ] != stats.IQ.Frames {
+		t.Fatalf("unexpected IQ frames %d (%d by type)", stats.IQ.Frames, stats.MessagesByType[msgTypeInt16IQ])
+	}
+	if stats.IQ.Bytes%stats.IQ.Frames != 0 || stats.IQ.Bytes/stats.IQ.Frames <= uint64(messageHeaderSize) {
+		t.Fatalf("unexpected IQ bytes %d for %d frames", stats.IQ.Bytes, stats.IQ.Frames)
+	}
+	if stats.Bytes < stats.IQ.Bytes+stats.FFT.Bytes || stats.MessagesByType[msgTypeDeviceInfo] != 1 {
+		t.Fatalf("unexpected totals %d bytes, %v", stats.Bytes, stats.MessagesByType)
+	}
+	if stats.IQ.Throughput <= 0 || stats.Throughput <= 0 {
+		t.Fatalf("unexpected throughput %f (IQ %f)", stats.Throughput, stats.IQ.Throughput)
+	}
+	if stats.DecodeErrors != 1 || stats.FFT.Frames != 1 || stats.FFT.Gaps != 0 {
+		t.Fatalf("unexpected FFT stats %+v and %d decode errors", stats.FFT, stats.DecodeErrors)
+	}
+	if stats.UnsupportedMessages != 1 || stats.MessagesByType[999] != 1 {
+		t.Fatalf("expected one unsupported message, got %d", stats.UnsupportedMessages)
+	}
+}
+
+func TestTotalStats(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = MakeSpyserverByFullHS(server.Addr)
+	var cb = newRecordingCallback()
+	s.SetCallback(cb)
+	s.SetReconnectPolicy(&ReconnectPolicy{InitialBackoff: 10 * time.Millisecond})
+	s.SetKeepalive(5*time.Millisecond, time.Second)
+
+	if err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Disconnect()
+
+	// Never read, so it discards all frames but one
+	s.IQChannel(1, spytypes.OverflowDropNewest)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var deadline = time.Now().Add(2 * time.Second)
+	for s.Stats().IQ.ChannelDrops < 5 || s.Stats().Pongs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for IQ frames and pongs")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	server.DropConnections()
+	cb.WaitFor(t, spytypes.Reconnected)
+
+	var total = s.TotalStats()
+	var current = s.Stats()
+	if total.IQ.Frames <= current.IQ.Frames || total.Bytes <= current.Bytes || total.Pongs < current.Pongs+1 {
+		t.Fatalf("expected the totals %+v to include the first connection, current %+v", total, current)
+	}
+	if total.MessagesByType[msgTypeDeviceInfo] != 2 {
+		t.Fatalf("expected a device info per connection, got %v", total.MessagesByType)
+	}
+
+	s.Disconnect()
+	if after := s.TotalStats(); after.IQ.ChannelDrops < total.IQ.ChannelDrops || after.IQ.Frames < total.IQ.Frames {
+		t.Fatalf("expected the totals to survive Disconnect, got %+v after %+v", after.IQ, total.IQ)
+	}
+}
+
+func TestSequenceGaps(t *testing.T) {
+	var now = time.Now()
+	var c streamCounters
+
+	for _, sequence := range []uint32{1, 2, 5, 3, 4, 4, 0, 2} {
+		c.add(now, sequence, 1)
+	}
+
+	// 2 -> 5 and 0 -> 2 are gaps, the rest restarts the tracking
+	if c.Frames != 8 || c.Gaps != 2 || c.DroppedFrames != 3 {
+		t.Fatalf("unexpected counters %+v", c.StreamStats)
+	}
+
+	var wrapped streamCounters
+	for _, sequence := range []uint32{math.MaxUint32 - 1, math.MaxUint32, 0, 1} {
+		wrapped.add(now, sequence, 1)
+	}
+	if wrapped.Gaps != 0 || wrapped.DroppedFrames != 0 {
+		t.Fatalf("unexpected counters after wrapping %+v", wrapped.StreamStats)
+	}
+}
+
+func TestReadSettingDecodeError(t *testing.T) {
+	var server = newFakeServer(t)
+	var s = connectToFake(t, server)
+
+	if err := server.Send(msgTypeReadSetting, 0, []uint8{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var deadline = time.Now().Add(2 * time.Second)
+	for s.Stats().DecodeErrors == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the malformed reply to be counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	var start = time.Now()
+	var tp throughput
+
+	if tp.rate(start) != 0 {
+		t.Fatal("expected no throughput before the first add")
+	}
+
+	for i := 0; i < 10; i++ {
+		tp.add(start.Add(time.Duration(i)*time.Second), 1000)
+	}
+	// The window only has the last 5 seconds
+	if r := tp.rate(start.Add(10 * time.Second)); r < 800 || r > 1200 {
+		t.Fatalf("expected about 1000 per second, got %f", r)
+	}
+	if r := tp.rate(start.Add(time.Minute)); r != 0 {
+		t.Fatalf("expected the window to expire, got %f", r)
+	}
+}
@@ -0,0 +1,151 @@
+package spyserver
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Change is a setting change sent by Apply.
+type Change struct {
+	// Setting is one of the Setting constants
+	Setting uint32
+	// Value is the requested value
+	Value uint32
+}
+
+// controlledSettings are the settings that the server ignores from a client without control of the device
+var controlledSettings = map[uint32]bool{
+	SettingGain:        true,
+	SettingIqFrequency: true,
+}
+
+// syncedSettings are the settings reported back by the server in ClientSync
+var syncedSettings = map[uint32]func(ClientSync) uint32{
+	SettingGain:         func(s ClientSync) uint32 { return s.Gain },
+	SettingIqFrequency:  func(s ClientSync) uint32 { return s.IQCenterFrequency },
+	SettingFFTFrequency: func(s ClientSync) uint32 { return s.FFTCenterFrequency },
+}
+
+// validSetting checks a value against the device capabilities.
+// Must be called with mtx held.
+func (f *Spyserver) validSetting(setting, value uint32) error {
+	switch setting {
+	case SettingGain:
+		if value > f.deviceInfo.MaximumGainIndex {
+			return ErrInvalidValue
+		}
+	case SettingStreamingMode:
+		switch value {
+		case StreamModeIQOnly, StreamModeAFOnly, StreamModeFFTOnly, StreamModeFFTIQ, StreamModeFFTAF:
+		default:
+			return ErrInvalidValue
+		}
+	case SettingIqFormat:
+		if value != StreamFormatUint8 && value != StreamFormatInt16 && value != StreamFormatInt24 && value != StreamFormatFloat {
+			return ErrInvalidValue
+		}
+		if forced := f.deviceInfo.ForcedIQFormat; forced != 0 && forced != value {
+			return fmt.Errorf("%w: the device forces the IQ format %d", ErrInvalidValue, forced)
+		}
+	case SettingFFTFormat:
+		if value != StreamFormatUint8 && value != StreamFormatDint4 && value != StreamFormatCompressed {
+			return ErrInvalidValue
+		}
+	case SettingIqDecimation:
+		return f.validIQStage(value)
+	case SettingFFTDecimation:
+		return f.validFFTStage(value)
+	}
+	return nil
+}
+
+// Apply sends the changes to the server and waits until it has processed them.
+// It returns the synchronization info received after the changes.
+//
+// The gain and the IQ and FFT center frequencies are checked against that info.
+// If the server clamped or refused any of them, the error is an *ApplyError and the getters return the actual values.
+// Other settings aren't reported back by the server and are assumed applied.
+// The changes are sent even if this client can't control the device, since the server accepts most settings anyway.
+// The gain and IQ frequency it refused for lack of control are marked NoControl, and the error matches ErrNoControl.
+//
+// The IQ blocks and FFT frames received after the returned sync, starting with the block marked Retuned, were produced
+// with the new settings. Frames already buffered in IQChannel and FFTChannel when Apply returns can be older.
+//
+// Apply waits for the answer to a ping sent after the changes. If the server never answers it, Apply blocks until ctx is done.
+func (f *Spyserver) Apply(ctx context.Context, changes ...Change) (ClientSync, error) {
+	var pong = make(chan error, 1)
+
+	f.mtx.Lock()
+	if !f.connected {
+		f.mtx.Unlock()
+		return ClientSync{}, ErrNotConnected
+	}
+	for _, c := range changes {
+		if err := f.validSetting(c.Setting, c.Value); err != nil {
+			f.mtx.Unlock()
+			return ClientSync{}, err
+		}
+	}
+
+	for _, c := range changes {
+		if err := f.setSetting(c.Setting, []uint32{c.Value}); err != nil {
+			f.mtx.Unlock()
+			return ClientSync{}, err
+		}
+		f.applyServerSetting(c.Setting, c.Value)
+	}
+
+	// The server handles the commands in order, so the pong comes after the sync of the last change
+	f.pendingPings = append(f.pendingPings, pendingPing{purpose: pingBarrier, sent: time.Now(), pong: pong})
+	if err := f.sendCommand(cmdPing, nil); err != nil {
+		f.mtx.Unlock()
+		return ClientSync{}, err
+	}
+	f.mtx.Unlock()
+
+	select {
+	case err := <-pong:
+		if err != nil {
+			return ClientSync{}, err
+		}
+	case <-ctx.Done():
+		return ClientSync{}, ctx.Err()
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var sync = f.lastSync
+	var applyErr = &ApplyError{}
+	for i, c := range changes {
+		if overridden(changes[i+1:], c.Setting) {
+			continue
+		}
+		if actual, ok := syncedSettings[c.Setting]; ok && actual(sync) != c.Value {
+			applyErr.Settings = append(applyErr.Settings, SettingMismatch{
+				Setting:   c.Setting,
+				Requested: c.Value,
+				Actual:    actual(sync),
+				NoControl: sync.CanControl == 0 && controlledSettings[c.Setting],
+			})
+			f.applyServerSetting(c.Setting, actual(sync))
+		}
+	}
+
+	if len(applyErr.Settings) > 0 {
+		return sync, applyErr
+	}
+
+	return sync, nil
+}
+
+// overridden returns true if one of the changes sets the setting again
+func overridden(changes []Change, setting uint32) bool {
+	for _, c := range changes {
+		if c.Setting == setting {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package spyserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// decodeAudio converts the demodulated audio samples to float32 between -1 and 1.
+// The audio is a single channel, so each sample is one value of the message format.
+func decodeAudio(msgType uint32, body []uint8) ([]float32, error) {
+	var samples []float32
+
+	switch msgType {
+	case msgTypeUint8AF:
+		samples = make([]float32, len(body))
+		for i, v := range body {
+			samples[i] = (float32(v) - 128) / 128
+		}
+	case msgTypeInt16AF:
+		samples = make([]float32, len(body)/2)
+		for i := range samples {
+			samples[i] = float32(int16(binary.LittleEndian.Uint16(body[i*2:]))) / (1 << 15)
+		}
+	case msgTypeInt24AF:
+		samples = make([]float32, len(body)/3)
+		for i := range samples {
+			samples[i] = float32(int24(body[i*3:])) / (1 << 23)
+		}
+	case msgTypeFloatAF:
+		samples = make([]float32, len(body)/4)
+		for i := range samples {
+			samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(body[i*4:]))
+		}
+	default:
+		// The compressed audio codec is not documented
+		return nil, fmt.Errorf("%w: unsupported audio message type %d", ErrMalformedMessage, msgType)
+	}
+
+	return samples, nil
+}
@@ -0,0 +1,102 @@
+package spyserver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+)
+
+// ErrNoDevice is returned by Connect when the server is up but has no device available.
+var ErrNoDevice = errors.New("spyserver: server is up but no device is available")
+
+// ErrProtocolVersion is returned when the server speaks an unsupported protocol version.
+// The actual error is a *ProtocolVersionError, which can be matched with errors.Is.
+var ErrProtocolVersion = errors.New("spyserver: unsupported protocol version")
+
+// ErrBodyTooLarge is returned when the server announces a message body bigger than the protocol allows.
+var ErrBodyTooLarge = wire.ErrBodyTooLarge
+
+// ErrHandshakeTimeout is returned by Connect when the server doesn't send the device and synchronization info in time.
+var ErrHandshakeTimeout = errors.New("spyserver: server didn't send the device capability and synchronization info")
+
+// ErrKeepaliveTimeout is reported when the server doesn't answer the keepalive ping in time.
+var ErrKeepaliveTimeout = errors.New("spyserver: keepalive timeout")
+
+// ErrNotConnected is returned when an operation requires an active connection to spyserver.
+var ErrNotConnected = errors.New("spyserver: not connected")
+
+// ErrInvalidValue is returned by the setters when the input is out of the range supported by the device.
+var ErrInvalidValue = errors.New("spyserver: invalid value")
+
+// ErrNoControl is matched by the error of Apply when the server refused a value because this client can't control the device.
+var ErrNoControl = errors.New("spyserver: client can't control the device")
+
+// ErrNotApplied is returned by Apply when the server didn't apply a value as requested.
+// The actual error is an *ApplyError, which can be matched with errors.Is.
+var ErrNotApplied = errors.New("spyserver: setting not applied")
+
+// ErrMalformedMessage is returned when a message from the server cannot be decoded.
+var ErrMalformedMessage = errors.New("spyserver: malformed message")
+
+// ProtocolVersionError describes a protocol version mismatch between spy2go and the server.
+type ProtocolVersionError struct {
+	Client uint32
+	Server uint32
+}
+
+func (e *ProtocolVersionError) Error() string {
+	return fmt.Sprintf("spyserver: unsupported protocol version %s (client speaks %s)", formatVersion(e.Server), formatVersion(e.Client))
+}
+
+// Is makes ProtocolVersionError match ErrProtocolVersion
+func (e *ProtocolVersionError) Is(target error) bool {
+	return target == ErrProtocolVersion
+}
+
+func formatVersion(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", (v>>24)&0xFF, (v>>16)&0xFF, v&0xFFFF)
+}
+
+// SettingMismatch is a setting that the server reported with a different value than requested.
+type SettingMismatch struct {
+	// Setting is one of the Setting constants
+	Setting uint32
+	// Requested is the value sent to the server
+	Requested uint32
+	// Actual is the value reported by the server
+	Actual uint32
+	// NoControl is true when the client couldn't control the device, so the server refused the value
+	NoControl bool
+}
+
+// ApplyError describes the settings that the server clamped or refused.
+type ApplyError struct {
+	Settings []SettingMismatch
+}
+
+func (e *ApplyError) Error() string {
+	var msg = "spyserver: setting not applied:"
+	for _, m := range e.Settings {
+		msg += fmt.Sprintf(" %d requested %d got %d", m.Setting, m.Requested, m.Actual)
+		if m.NoControl {
+			msg += " without control"
+		}
+		msg += ";"
+	}
+	return msg[:len(msg)-1]
+}
+
+// Is makes ApplyError match ErrNotApplied, and ErrNoControl if a value was refused for lack of control
+func (e *ApplyError) Is(target error) bool {
+	switch target {
+	case ErrNotApplied:
+		return true
+	case ErrNoControl:
+		for _, m := range e.Settings {
+			if m.NoControl {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package spyserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// The protocol doesn't document the Dint4 and compressed FFT payloads. The decoders below assume:
+//
+// Dint4 carries two bins per byte, the first bin in the high nibble. Each 4 bit value is scaled
+// to the 8 bit range, so 0xF becomes 0xFF and the bins can be used like the Uint8 ones.
+//
+// Compressed is a raw DEFLATE stream of the Uint8 bins.
+
+// decodeDint4FFT expands the 4 bit FFT bins to 8 bits
+func decodeDint4FFT(body []uint8) []uint8 {
+	var bins = make([]uint8, len(body)*2)
+	for i, v := range body {
+		bins[i*2] = (v >> 4) * 0x11
+		bins[i*2+1] = (v & 0xF) * 0x11
+	}
+	return bins
+}
+
+// decodeCompressedFFT inflates the FFT bins. The output is limited to the maximum message body size.
+func decodeCompressedFFT(body []uint8) ([]uint8, error) {
+	var r = flate.NewReader(bytes.NewReader(body))
+	defer r.Close()
+
+	bins, err := io.ReadAll(io.LimitReader(r, spyserverMaxMessageBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: compressed fft: %v", ErrMalformedMessage, err)
+	}
+	if len(bins) > spyserverMaxMessageBodySize {
+		return nil, fmt.Errorf("%w: compressed fft bigger than %d bytes", ErrBodyTooLarge, spyserverMaxMessageBodySize)
+	}
+
+	return bins, nil
+}
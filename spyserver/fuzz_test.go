@@ -0,0 +1,173 @@
+package spyserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/racerxdl/spy2go/spyserver/spyservertest"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"github.com/racerxdl/spy2go/spytypes"
+	"io"
+	"testing"
+)
+
+// chunkReader returns the data in reads of the sizes given by splits, cycling over them
+type chunkReader struct {
+	data   []byte
+	splits []byte
+	n      int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	var size = len(p)
+	if len(r.splits) > 0 {
+		size = min(size, int(r.splits[r.n%len(r.splits)])+1)
+		r.n++
+	}
+	size = min(size, len(r.data))
+
+	copy(p, r.data[:size])
+	r.data = r.data[size:]
+	return size, nil
+}
+
+// parseResult is what the client got from a stream
+type parseResult struct {
+	messages map[uint32]uint64
+	iq       []spytypes.SampleBlock
+	fft      [][]uint8
+	audio    [][]float32
+	syncs    []spytypes.DeviceSyncEvent
+	err      error
+}
+
+// parseStream feeds a stream to the client message parser until the first error
+func parseStream(r io.Reader) parseResult {
+	var result parseResult
+	var s = MakeSpyserverByFullHS("127.0.0.1:0")
+	s.SetHandler(spytypes.Handler{
+		OnSampleBlock: func(block spytypes.SampleBlock) { result.iq = append(result.iq, block) },
+		OnFFT:         func(bins []uint8) { result.fft = append(result.fft, bins) },
+		OnAudio:       func(frame spytypes.AudioFrame) { result.audio = append(result.audio, frame.Samples) },
+		OnSyncEvent:   func(e spytypes.DeviceSyncEvent) { result.syncs = append(result.syncs, e) },
+	})
+	s.resetParser(r)
+
+	for result.err == nil {
+		result.err = s.readMessage()
+	}
+	result.messages = s.Stats().MessagesByType
+
+	return result
+}
+
+// equalBlocks compares the samples and metadata of two IQ blocks, except the timestamp
+func equalBlocks(a, b spytypes.SampleBlock) bool {
+	var sameSamples = len(a.Complex64) == len(b.Complex64) &&
+		len(a.ComplexInt16) == len(b.ComplexInt16) &&
+		len(a.ComplexUInt8) == len(b.ComplexUInt8) &&
+		len(a.ComplexInt32) == len(b.ComplexInt32)
+	for i := 0; sameSamples && i < len(a.ComplexInt16); i++ {
+		sameSamples = a.ComplexInt16[i] == b.ComplexInt16[i]
+	}
+	for i := 0; sameSamples && i < len(a.ComplexInt32); i++ {
+		sameSamples = a.ComplexInt32[i] == b.ComplexInt32[i]
+	}
+	for i := 0; sameSamples && i < len(a.ComplexUInt8); i++ {
+		sameSamples = a.ComplexUInt8[i] == b.ComplexUInt8[i]
+	}
+	for i := 0; sameSamples && i < len(a.Complex64); i++ {
+		// NaN payloads don't compare equal
+		sameSamples = a.Complex64[i] == b.Complex64[i] || a.Complex64[i] != a.Complex64[i]
+	}
+
+	return sameSamples && a.SequenceNumber == b.SequenceNumber && a.MessageType == b.MessageType &&
+		a.SampleIndex == b.SampleIndex && a.CenterFrequency == b.CenterFrequency
+}
+
+func fuzzMessage(msgType, streamType uint32, body interface{}) []byte {
+	var payload bytes.Buffer
+	if body != nil {
+		binary.Write(&payload, binary.LittleEndian, body)
+	}
+	return wire.AppendMessage(nil, messageHeader{
+		ProtocolID:  SpyserverProtocolVersion,
+		MessageType: msgType,
+		StreamType:  streamType,
+	}, payload.Bytes())
+}
+
+func FuzzParser(f *testing.F) {
+	var info = DeviceInfo{DeviceType: DeviceAirspyOne, MaximumSampleRate: 10000000, DecimationStageCount: 8}
+	var sync = ClientSync{CanControl: 1, IQCenterFrequency: 100000000}
+
+	var stream []byte
+	stream = append(stream, fuzzMessage(msgTypeDeviceInfo, 0, info)...)
+	stream = append(stream, fuzzMessage(msgTypeClientSync, 0, sync)...)
+	stream = append(stream, fuzzMessage(msgTypePong, 0, nil)...)
+	stream = append(stream, fuzzMessage(msgTypeReadSetting, 0, []uint32{SettingGain, 5})...)
+	for _, format := range []uint32{StreamFormatUint8, StreamFormatInt16, StreamFormatInt24, StreamFormatFloat} {
+		msgType, samples := spyservertest.IQMessage(format)
+		stream = append(stream, fuzzMessage(msgType, StreamTypeIQ, samples)...)
+	}
+	for _, format := range []uint32{StreamFormatUint8, StreamFormatDint4, StreamFormatCompressed} {
+		msgType, bins := spyservertest.FFTMessage(format)
+		stream = append(stream, fuzzMessage(msgType, StreamTypeFFT, bins)...)
+	}
+	var afType, audio = spyservertest.AFMessage()
+	stream = append(stream, fuzzMessage(afType, StreamTypeAF, audio)...)
+
+	f.Add(stream, []byte{0})
+	f.Add(stream, []byte{19, 1, 255})
+	f.Add(fuzzMessage(msgTypeDeviceInfo, 0, []uint32{1, 2}), []byte{})
+	f.Add(fuzzMessage(msgTypeCompressedFFT, StreamTypeFFT, []uint8{0xff, 0xff, 0xff}), []byte{})
+	f.Add(fuzzMessage(msgTypeInt24IQ, StreamTypeIQ, make([]uint8, 11)), []byte{4})
+
+	f.Fuzz(func(t *testing.T, stream, splits []byte) {
+		var whole = parseStream(bytes.NewReader(stream))
+		var chunked = parseStream(&chunkReader{data: stream, splits: splits})
+
+		for _, err := range []error{whole.err, chunked.err} {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, ErrMalformedMessage) &&
+				!errors.Is(err, ErrBodyTooLarge) && !errors.Is(err, ErrProtocolVersion) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+		if whole.err.Error() != chunked.err.Error() {
+			t.Fatalf("got %v from the whole stream and %v from chunks", whole.err, chunked.err)
+		}
+
+		if len(whole.messages) != len(chunked.messages) {
+			t.Fatalf("got messages %v from the whole stream and %v from chunks", whole.messages, chunked.messages)
+		}
+		for msgType, count := range whole.messages {
+			if chunked.messages[msgType] != count {
+				t.Fatalf("got messages %v from the whole stream and %v from chunks", whole.messages, chunked.messages)
+			}
+		}
+
+		if len(whole.iq) != len(chunked.iq) || len(whole.fft) != len(chunked.fft) ||
+			len(whole.audio) != len(chunked.audio) || len(whole.syncs) != len(chunked.syncs) {
+			t.Fatal("got different frames from the whole stream and from chunks")
+		}
+		for i := range whole.iq {
+			if !equalBlocks(whole.iq[i], chunked.iq[i]) {
+				t.Fatalf("IQ block %d differs", i)
+			}
+		}
+		for i := range whole.fft {
+			if !bytes.Equal(whole.fft[i], chunked.fft[i]) {
+				t.Fatalf("FFT frame %d differs", i)
+			}
+		}
+		for i := range whole.syncs {
+			if whole.syncs[i] != chunked.syncs[i] {
+				t.Fatalf("sync event %d differs", i)
+			}
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package spyserver
+
+import "math"
+
+// GainStep is a gain index accepted by SetGain and its approximate gain.
+type GainStep struct {
+	// Index is the gain stage index
+	Index uint32
+	// DB is the approximate gain in dB
+	DB float32
+}
+
+// defaultGainTables are the approximate gains in dB of each gain index, by device type.
+// They are read-only, each client starts with them and SetGainTable changes its own tables.
+// Devices without a table use one dB per index.
+var defaultGainTables = map[uint32][]float32{
+	// Airspy linearity gain, roughly 2 dB per step up to the maximum gain of the LNA, mixer and VGA
+	DeviceAirspyOne: {
+		0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20,
+		22, 24, 26, 28, 30, 32, 34, 36, 38, 40, 42,
+	},
+	// Airspy HF+ front end attenuator, 6 dB steps from -48 dB to no attenuation
+	DeviceAirspyHf: {-48, -42, -36, -30, -24, -18, -12, -6, 0},
+	// R820T tuner gains
+	DeviceRtlsdr: {
+		0.0, 0.9, 1.4, 2.7, 3.7, 7.7, 8.7, 12.5, 14.4, 15.7,
+		16.6, 19.7, 20.7, 22.9, 25.4, 28.0, 29.7, 32.8, 33.8, 36.4,
+		37.2, 38.6, 40.2, 42.1, 43.4, 43.9, 44.5, 48.0, 49.6,
+	},
+}
+
+// DefaultGainTable returns a copy of the approximate gains in dB of each gain index of a device type,
+// or nil if the device type doesn't have a table.
+func DefaultGainTable(deviceType uint32) []float32 {
+	return append([]float32(nil), defaultGainTables[deviceType]...)
+}
+
+// SetGainTable replaces the approximate gains in dB of each gain index of a device type, for this client only.
+// It can be used to adjust the gains for a specific setup. A nil table uses one dB per index.
+func (f *Spyserver) SetGainTable(deviceType uint32, table []float32) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.gainTables[deviceType] = append([]float32(nil), table...)
+}
+
+// gainSteps returns the gain steps of the current device.
+// Must be called with mtx held.
+func (f *Spyserver) gainSteps() []GainStep {
+	if !f.gotDeviceInfo {
+		return []GainStep{}
+	}
+
+	var table = f.gainTables[f.deviceInfo.DeviceType]
+	var steps = make([]GainStep, f.deviceInfo.MaximumGainIndex+1)
+	for i := range steps {
+		steps[i].Index = uint32(i)
+		switch {
+		case len(table) == 0:
+			steps[i].DB = float32(i)
+		case i < len(table):
+			steps[i].DB = table[i]
+		default:
+			// The server has more stages than the table
+			steps[i].DB = table[len(table)-1]
+		}
+	}
+	return steps
+}
+
+// GetGainSteps returns the gain indexes of the current device with their approximate gain in dB.
+// It is empty when not connected.
+func (f *Spyserver) GetGainSteps() []GainStep {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.gainSteps()
+}
+
+// SetGainDB sets the gain index with the nearest approximate gain to db.
+func (f *Spyserver) SetGainDB(db float32) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !f.connected {
+		return ErrNotConnected
+	}
+
+	var steps = f.gainSteps()
+	if len(steps) == 0 {
+		return ErrInvalidValue
+	}
+
+	var nearest = steps[0]
+	for _, step := range steps[1:] {
+		if math.Abs(float64(step.DB-db)) < math.Abs(float64(nearest.DB-db)) {
+			nearest = step
+		}
+	}
+
+	return f.setGain(nearest.Index)
+}
+
+// GetGainDB returns the approximate gain in dB of the current gain index.
+func (f *Spyserver) GetGainDB() float32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var steps = f.gainSteps()
+	if f.gain >= uint32(len(steps)) {
+		return 0
+	}
+	return steps[f.gain].DB
+}
@@ -0,0 +1,145 @@
+package spyserver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// LatencyStats are the round trip times measured with the keepalive pings.
+type LatencyStats struct {
+	// Last is the round trip time of the last pong
+	Last time.Duration
+	// Min is the lowest round trip time
+	Min time.Duration
+	// Max is the highest round trip time
+	Max time.Duration
+	// Avg is the average round trip time
+	Avg time.Duration
+	// Count is the number of pongs received
+	Count uint64
+}
+
+// add accounts a new round trip time
+func (l *LatencyStats) add(rtt time.Duration) {
+	if l.Count == 0 || rtt < l.Min {
+		l.Min = rtt
+	}
+	if rtt > l.Max {
+		l.Max = rtt
+	}
+	l.Avg = (l.Avg*time.Duration(l.Count) + rtt) / time.Duration(l.Count+1)
+	l.Last = rtt
+	l.Count++
+}
+
+// pingPurpose tells why a ping was sent
+type pingPurpose int
+
+const (
+	// pingKeepalive pings measure the latency and check the connection
+	pingKeepalive pingPurpose = iota
+	// pingBarrier pings wait until the server has handled the previous commands
+	pingBarrier
+)
+
+// pendingPing is a ping waiting for its pong
+type pendingPing struct {
+	purpose pingPurpose
+	sent    time.Time
+	// pong receives nil when the pong arrives, or ErrNotConnected if the connection is lost first.
+	// It is nil for the keepalive pings.
+	pong chan error
+	// onPong is called with mtx held when the pong arrives, if not nil
+	onPong func()
+}
+
+// keepalive sends a ping every interval while conn is the active connection.
+// If the oldest ping has no pong after timeout, the connection is closed and the reader fails with ErrKeepaliveTimeout.
+// The timeout is checked at each interval.
+func (f *Spyserver) keepalive(ctx context.Context, conn net.Conn, interval, timeout time.Duration) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		f.mtx.Lock()
+		if f.client != conn {
+			f.mtx.Unlock()
+			return
+		}
+
+		if timeout > 0 && len(f.pendingPings) > 0 && time.Since(f.pendingPings[0].sent) > timeout {
+			f.keepaliveTimedOut = true
+			f.mtx.Unlock()
+			conn.Close()
+			return
+		}
+
+		f.pendingPings = append(f.pendingPings, pendingPing{purpose: pingKeepalive, sent: time.Now()})
+		err := f.sendCommand(cmdPing, nil)
+		f.mtx.Unlock()
+
+		if err != nil {
+			// The reader sees the broken connection too
+			return
+		}
+	}
+}
+
+func (f *Spyserver) processPong() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if len(f.pendingPings) == 0 {
+		return
+	}
+
+	var ping = f.pendingPings[0]
+	if ping.purpose == pingKeepalive {
+		// Barrier pings wait behind other commands, so they don't measure the round trip
+		f.latency.add(f.receivedAt.Sub(ping.sent))
+		f.stats.pongs++
+	}
+	f.pendingPings = f.pendingPings[1:]
+	if ping.onPong != nil {
+		ping.onPong()
+	}
+	if ping.pong != nil {
+		ping.pong <- nil
+	}
+}
+
+// cancelPings fails all pings that wait for a pong, because the connection is gone.
+// Must be called with mtx held.
+func (f *Spyserver) cancelPings() {
+	for _, ping := range f.pendingPings {
+		if ping.pong != nil {
+			ping.pong <- ErrNotConnected
+		}
+	}
+	f.pendingPings = nil
+}
+
+// SetKeepalive enables a ping every interval, closing the connection if a pong doesn't arrive within timeout.
+// A lost connection is reported like any other, so the reconnect policy applies.
+// Zero interval disables it, which is the default. Zero timeout only measures the latency.
+// It takes effect on the next connection.
+func (f *Spyserver) SetKeepalive(interval, timeout time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.keepaliveInterval = interval
+	f.keepaliveTimeout = timeout
+}
+
+// Latency returns the round trip times measured by the keepalive since Connect.
+func (f *Spyserver) Latency() LatencyStats {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.latency
+}
@@ -1,6 +1,9 @@
 package spyserver
 
-import "unsafe"
+import (
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"time"
+)
 
 // SoftwareID the software ID that gets sent to SpyServer in sayHello.
 // You can replace the default value for your own application name.
@@ -8,10 +11,9 @@ var SoftwareID = "Spy2Go 1.0"
 
 // SpyserverProtocolVersion packed into a integer.
 // Defined by ((major) << 24) | ((minor) << 16) | (revision)
-const SpyserverProtocolVersion = ((2) << 24) | ((0) << 16) | (1558)
+const SpyserverProtocolVersion = wire.ProtocolVersion
 
-//const SpyserverMaxCommandBodySize = 256
-const spyserverMaxMessageBodySize = 1 << 20
+const spyserverMaxMessageBodySize = wire.MaxMessageBodySize
 
 // SpyserverMaxDisplayPixels is the max possible pixels for Spyserver FFT width
 const SpyserverMaxDisplayPixels = 1 << 15
@@ -29,16 +31,19 @@ const SpyserverMaxFFTDBOffset = 100
 
 const defaultFFTRange = 127
 const defaultDisplayPixels = 2000
+const defaultHandshakeTimeout = 4 * time.Second
 
-// InvalidValue is a constant that is returned in any of the functions that can receive invalid values.
+// InvalidValue was returned by the setters in case of invalid values.
+//
+// Deprecated: the setters now return ErrInvalidValue.
 const InvalidValue = 0xFFFFFFFF
 
 // DeviceIds IDs of the devices in spyserver
 const (
-	DeviceInvalid   = 0
-	DeviceAirspyOne = 1
-	DeviceAirspyHf  = 2
-	DeviceRtlsdr    = 3
+	DeviceInvalid   = wire.DeviceInvalid
+	DeviceAirspyOne = wire.DeviceAirspyOne
+	DeviceAirspyHf  = wire.DeviceAirspyHf
+	DeviceRtlsdr    = wire.DeviceRtlsdr
 )
 
 // DeviceNames names of the devices
@@ -58,45 +63,45 @@ var DeviceName = map[uint32]string{
 }
 
 const (
-	cmdHello      = 0
-	cmdGetSetting = 1
-	cmdSetSetting = 2
-	cmdPing       = 3
+	cmdHello      = wire.CmdHello
+	cmdGetSetting = wire.CmdGetSetting
+	cmdSetSetting = wire.CmdSetSetting
+	cmdPing       = wire.CmdPing
 )
 
+// Settings are the setting types that can be read with GetSettingFromServer.
 const (
-	settingStreamingMode    = 0
-	settingStreamingEnabled = 1
-	settingGain             = 2
-
-	settingIqFormat     = 100
-	settingIqFrequency  = 101
-	settingIqDecimation = 102
-
-	settingFFTFormat        = 200
-	settingFFTFrequency     = 201
-	settingFFTDecimation    = 202
-	settingFFTDbOffset      = 203
-	settingFFTDbRange       = 204
-	settingFFTDisplayPixels = 205
+	SettingStreamingMode    = wire.SettingStreamingMode
+	SettingStreamingEnabled = wire.SettingStreamingEnabled
+	SettingGain             = wire.SettingGain
+
+	SettingIqFormat     = wire.SettingIqFormat
+	SettingIqFrequency  = wire.SettingIqFrequency
+	SettingIqDecimation = wire.SettingIqDecimation
+
+	SettingFFTFormat        = wire.SettingFFTFormat
+	SettingFFTFrequency     = wire.SettingFFTFrequency
+	SettingFFTDecimation    = wire.SettingFFTDecimation
+	SettingFFTDbOffset      = wire.SettingFFTDbOffset
+	SettingFFTDbRange       = wire.SettingFFTDbRange
+	SettingFFTDisplayPixels = wire.SettingFFTDisplayPixels
 )
 
 // StreamTypes is a enum that defines which stream types the spyserver supports.
 const (
 	//StreamTypeStatus = 0
 
-	StreamTypeIQ = 1
-
-	//StreamTypeAF     = 2
-
-	StreamTypeFFT = 4
+	StreamTypeIQ  = wire.StreamTypeIQ
+	StreamTypeAF  = wire.StreamTypeAF
+	StreamTypeFFT = wire.StreamTypeFFT
 )
 
 const (
 	// StreamModeIQOnly only enables IQ Channel
 	StreamModeIQOnly = StreamTypeIQ
 
-	//StreamModeAFOnly  = StreamTypeAF
+	// StreamModeAFOnly only enables the demodulated audio Channel
+	StreamModeAFOnly = StreamTypeAF
 
 	// StreamModeFFTOnly only enables FFT Channel
 	StreamModeFFTOnly = StreamTypeFFT
@@ -104,53 +109,45 @@ const (
 	// StreamModeFFTOnly only enables both IQ and FFT Channels
 	StreamModeFFTIQ = StreamTypeFFT | StreamTypeIQ
 
-	//StreamModeFFTAF   = StreamTypeFFT | StreamTypeAF
+	// StreamModeFFTAF enables both FFT and demodulated audio Channels
+	StreamModeFFTAF = StreamTypeFFT | StreamTypeAF
 )
 
 const (
-	//StreamFormatDint4      = 0
-
-	StreamFormatUint8 = 1
-	StreamFormatInt16 = 2
-
-	//StreamFormatInt24      = 3
+	// StreamFormatDint4 packs two 4 bit FFT bins per byte. FFT only.
+	StreamFormatDint4 = wire.StreamFormatDint4
 
-	StreamFormatFloat = 4
+	StreamFormatUint8 = wire.StreamFormatUint8
+	StreamFormatInt16 = wire.StreamFormatInt16
+	StreamFormatInt24 = wire.StreamFormatInt24
+	StreamFormatFloat = wire.StreamFormatFloat
 
-	//StreamFormatCompressed = 5
+	// StreamFormatCompressed sends DEFLATE compressed 8 bit FFT bins. FFT only.
+	StreamFormatCompressed = wire.StreamFormatCompressed
 )
 
 const (
-	msgTypeDeviceInfo  = 0
-	msgTypeClientSync  = 1
-	msgTypePong        = 2
-	msgTypeReadSetting = 3
+	msgTypeDeviceInfo  = wire.MsgTypeDeviceInfo
+	msgTypeClientSync  = wire.MsgTypeClientSync
+	msgTypePong        = wire.MsgTypePong
+	msgTypeReadSetting = wire.MsgTypeReadSetting
 
-	msgTypeUint8IQ = 100
-	msgTypeInt16IQ = 101
-
-	//msgTypeInt24IQ      = 102
-
-	msgTypeFloatIQ = 103
+	msgTypeUint8IQ = wire.MsgTypeUint8IQ
+	msgTypeInt16IQ = wire.MsgTypeInt16IQ
+	msgTypeInt24IQ = wire.MsgTypeInt24IQ
+	msgTypeFloatIQ = wire.MsgTypeFloatIQ
 
 	//msgTypeCompressedIQ = 104
 
-	//msgTypeUint8AF      = 200
-	//msgTypeInt16AF      = 201
-	//msgTypeInt24AF      = 202
-	//msgTypeFloatAF      = 203
-	//msgTypeCompressedAF = 204
-
-	//msgTypeDint4FFT      = 300
-
-	msgTypeUint8FFT = 301
+	msgTypeUint8AF      = wire.MsgTypeUint8AF
+	msgTypeInt16AF      = wire.MsgTypeInt16AF
+	msgTypeInt24AF      = wire.MsgTypeInt24AF
+	msgTypeFloatAF      = wire.MsgTypeFloatAF
+	msgTypeCompressedAF = wire.MsgTypeCompressedAF
 
-	//msgTypeCompressedFFT = 302
-)
-
-const (
-	parserAcquiringHeader = iota
-	parserReadingData     = iota
+	msgTypeDint4FFT      = wire.MsgTypeDint4FFT
+	msgTypeUint8FFT      = wire.MsgTypeUint8FFT
+	msgTypeCompressedFFT = wire.MsgTypeCompressedFFT
 )
 
 //type clientHandshake struct {
@@ -158,49 +155,19 @@ const (
 //	ClientNameLength uint32
 //}
 
-type commandHeader struct {
-	CommandType uint32
-	BodySize    uint32
-}
+type commandHeader = wire.CommandHeader
 
 //type settingTarget struct {
 //	StreamType uint32
 //	SettingType uint32
 //}
 
-type messageHeader struct {
-	ProtocolID     uint32
-	MessageType    uint32
-	StreamType     uint32
-	SequenceNumber uint32
-	BodySize       uint32
-}
+type messageHeader = wire.MessageHeader
 
-const messageHeaderSize = uint32(unsafe.Sizeof(messageHeader{}))
-
-type deviceInfo struct {
-	DeviceType           uint32
-	DeviceSerial         uint32
-	MaximumSampleRate    uint32
-	MaximumBandwidth     uint32
-	DecimationStageCount uint32
-	GainStageCount       uint32
-	MaximumGainIndex     uint32
-	MinimumFrequency     uint32
-	MaximumFrequency     uint32
-	Resolution           uint32
-	MinimumIQDecimation  uint32
-	ForcedIQFormat       uint32
-}
+const messageHeaderSize = uint32(wire.MessageHeaderSize)
 
-type clientSync struct {
-	CanControl                uint32
-	Gain                      uint32
-	DeviceCenterFrequency     uint32
-	IQCenterFrequency         uint32
-	FFTCenterFrequency        uint32
-	MinimumIQCenterFrequency  uint32
-	MaximumIQCenterFrequency  uint32
-	MinimumFFTCenterFrequency uint32
-	MaximumFFTCenterFrequency uint32
-}
+// DeviceInfo is the device capability info sent by spyserver on connection.
+type DeviceInfo = wire.DeviceInfo
+
+// ClientSync is the synchronization info sent by spyserver when the device state changes.
+type ClientSync = wire.ClientSync
@@ -0,0 +1,95 @@
+package spyserver
+
+import "fmt"
+
+// SampleRate is a sample rate supported by the device behind spyserver.
+type SampleRate struct {
+	// DecimationStage is the number of decimation by two stages applied to the device sample rate
+	DecimationStage uint32
+	// SampleRate is the sample rate, in samples per second
+	SampleRate uint32
+	// Bandwidth is the usable bandwidth, in Hz
+	Bandwidth uint32
+}
+
+// maxDecimationStages bounds the decimation stages taken from DeviceInfo.
+// The rates are MaximumSampleRate >> stage, so the stages past 31 would all be 0 Hz.
+const maxDecimationStages = 32
+
+// buildSampleRates returns the sample rates of every decimation stage of the device, indexed by stage.
+// The usable bandwidth keeps the ratio between the maximum bandwidth and the maximum sample rate.
+// The stage count comes from the server, so it is capped at maxDecimationStages.
+func buildSampleRates(info DeviceInfo) []SampleRate {
+	var rates = make([]SampleRate, min(info.DecimationStageCount, maxDecimationStages))
+	for i := range rates {
+		var rate = info.MaximumSampleRate >> uint(i)
+		var bandwidth = uint32(0)
+		if info.MaximumSampleRate > 0 {
+			bandwidth = uint32(uint64(rate) * uint64(info.MaximumBandwidth) / uint64(info.MaximumSampleRate))
+		}
+		rates[i] = SampleRate{
+			DecimationStage: uint32(i),
+			SampleRate:      rate,
+			Bandwidth:       bandwidth,
+		}
+	}
+	return rates
+}
+
+// validIQStage checks that the IQ channel can use the decimation stage.
+// Must be called with mtx held.
+func (f *Spyserver) validIQStage(stage uint32) error {
+	if stage < f.deviceInfo.MinimumIQDecimation {
+		return fmt.Errorf("%w: decimation stage %d is below the device minimum %d for IQ", ErrInvalidValue, stage, f.deviceInfo.MinimumIQDecimation)
+	}
+	return f.validFFTStage(stage)
+}
+
+// validFFTStage checks that the FFT channel can use the decimation stage.
+// Must be called with mtx held.
+func (f *Spyserver) validFFTStage(stage uint32) error {
+	if stage >= uint32(len(f.sampleRates)) {
+		return fmt.Errorf("%w: decimation stage %d, the device has %d stages", ErrInvalidValue, stage, len(f.sampleRates))
+	}
+	return nil
+}
+
+// findStage returns the first stage with the given sample rate, starting at minStage.
+// Must be called with mtx held.
+func (f *Spyserver) findStage(sampleRate, minStage uint32) (uint32, error) {
+	for i := minStage; i < uint32(len(f.sampleRates)); i++ {
+		if f.sampleRates[i].SampleRate == sampleRate {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: sample rate %d is not available", ErrInvalidValue, sampleRate)
+}
+
+// GetIQSampleRates returns the sample rates that the IQ channel can use, from the highest.
+// It is empty when not connected.
+func (f *Spyserver) GetIQSampleRates() []SampleRate {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.deviceInfo.MinimumIQDecimation >= uint32(len(f.sampleRates)) {
+		return []SampleRate{}
+	}
+	return append([]SampleRate(nil), f.sampleRates[f.deviceInfo.MinimumIQDecimation:]...)
+}
+
+// GetFFTSampleRates returns the sample rates that the FFT channel can use, from the highest.
+// It is empty when not connected.
+func (f *Spyserver) GetFFTSampleRates() []SampleRate {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]SampleRate(nil), f.sampleRates...)
+}
+
+// GetBandwidth returns the usable bandwidth of the IQ Channel in Hertz.
+func (f *Spyserver) GetBandwidth() uint32 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.channelDecimationStageCount >= uint32(len(f.sampleRates)) {
+		return 0
+	}
+	return f.sampleRates[f.channelDecimationStageCount].Bandwidth
+}
@@ -0,0 +1,79 @@
+package spyserver
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy defines how Spyserver reconnects after losing the connection.
+// Use SetReconnectPolicy to enable it. Zero fields are replaced by the DefaultReconnectPolicy values.
+type ReconnectPolicy struct {
+	// InitialBackoff is the wait before the first reconnect attempt
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum wait between two attempts
+	MaxBackoff time.Duration
+	// Multiplier is applied to the wait after each failed attempt
+	Multiplier float64
+	// Jitter is the fraction of the wait that is randomized, between 0 and 1
+	Jitter float64
+	// MaxAttempts is the number of consecutive failed attempts before giving up. Zero means forever.
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy is a reasonable policy for most servers.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// backoff returns the wait before the given attempt, starting at 1.
+func (p ReconnectPolicy) backoff(attempt int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultReconnectPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultReconnectPolicy.MaxBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = DefaultReconnectPolicy.Multiplier
+	}
+
+	var wait = float64(p.InitialBackoff)
+	for i := 1; i < attempt && wait < float64(p.MaxBackoff); i++ {
+		wait *= p.Multiplier
+	}
+	if wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+
+	if p.Jitter > 0 {
+		wait += wait * p.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(wait)
+}
+
+// replayOrder is the order that the settings are sent to the server after (re)connecting.
+var replayOrder = []uint32{
+	SettingStreamingMode,
+	SettingIqFormat,
+	SettingFFTFormat,
+	SettingIqFrequency,
+	SettingIqDecimation,
+	SettingFFTFrequency,
+	SettingFFTDecimation,
+	SettingFFTDbOffset,
+	SettingFFTDbRange,
+	SettingFFTDisplayPixels,
+	SettingGain,
+	SettingStreamingEnabled,
+}
+
+// Reconnects returns how many times the connection was restored by the reconnect policy.
+func (f *Spyserver) Reconnects() uint64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.reconnects
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// clientQueueSize is the number of messages buffered for a client.
+// Sample frames are dropped when the queue is full, other messages disconnect the client.
+const clientQueueSize = 64
+
+// FFT display limits, the same ones enforced by the spyserver client
+const (
+	minDisplayPixels = 100
+	maxDisplayPixels = 1 << 15
+	minDbRange       = 10
+	maxDbRange       = 150
+)
+
+// client is a connection to a spyserver client
+type client struct {
+	server *Server
+	conn   net.Conn
+	name   string
+
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sendMtx  sync.Mutex
+	sequence map[uint32]uint32
+
+	mtx       sync.Mutex
+	mode      uint32
+	streaming bool
+	iqFormat  uint32
+	fftFormat uint32
+	iq        channel
+	fft       spectrum
+}
+
+func newClient(s *Server, conn net.Conn) *client {
+	var c = &client{
+		server:    s,
+		conn:      conn,
+		queue:     make(chan []byte, clientQueueSize),
+		done:      make(chan struct{}),
+		sequence:  map[uint32]uint32{},
+		mode:      wire.StreamTypeIQ,
+		iqFormat:  wire.StreamFormatInt16,
+		fftFormat: wire.StreamFormatUint8,
+		iq: channel{
+			stage: s.info.MinimumIQDecimation,
+		},
+		fft: spectrum{
+			pixels:  1024,
+			rangeDB: 127,
+		},
+	}
+
+	if s.info.ForcedIQFormat != 0 {
+		c.iqFormat = s.info.ForcedIQFormat
+	}
+
+	return c
+}
+
+// serve handles the commands of the client until it disconnects
+func (c *client) serve() {
+	defer c.close()
+	go c.writeLoop()
+
+	var decoder = wire.NewDecoder(bufio.NewReader(c.conn))
+
+	if timeout := c.server.getHelloTimeout(); timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	header, body, err := decoder.ReadCommand()
+	if err != nil || header.CommandType != wire.CmdHello || len(body) < 4 {
+		log.Printf("Client %s didn't say hello\n", c.conn.RemoteAddr())
+		return
+	}
+	c.conn.SetReadDeadline(time.Time{})
+
+	var version = binary.LittleEndian.Uint32(body)
+	if !wire.Compatible(version, wire.ProtocolVersion) {
+		log.Printf("Client %s speaks protocol version %08x, expected %08x\n", c.conn.RemoteAddr(), version, uint32(wire.ProtocolVersion))
+		return
+	}
+
+	c.name = string(body[4:])
+	if !c.server.register(c) {
+		return
+	}
+	defer c.server.unregister(c)
+
+	log.Printf("Client %q connected from %s\n", c.name, c.conn.RemoteAddr())
+
+	for {
+		header, body, err := decoder.ReadCommand()
+		if err != nil {
+			log.Printf("Client %q disconnected: %s\n", c.name, err)
+			return
+		}
+
+		switch header.CommandType {
+		case wire.CmdSetSetting:
+			if len(body) >= 8 {
+				c.server.setSetting(c, binary.LittleEndian.Uint32(body), binary.LittleEndian.Uint32(body[4:]))
+			}
+		case wire.CmdGetSetting:
+			if len(body) < 4 {
+				break
+			}
+			var setting = binary.LittleEndian.Uint32(body)
+			if value, ok := c.server.getSetting(c, setting); ok {
+				var reply = binary.LittleEndian.AppendUint32(nil, setting)
+				c.send(wire.MsgTypeReadSetting, wire.StreamTypeStatus, binary.LittleEndian.AppendUint32(reply, value), false)
+			}
+		case wire.CmdPing:
+			c.send(wire.MsgTypePong, wire.StreamTypeStatus, nil, false)
+		}
+	}
+}
+
+// writeLoop writes the queued messages until the client is closed
+func (c *client) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.queue:
+			if _, err := c.conn.Write(msg); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close disconnects the client. It is safe to call close more than once.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// send queues a message. Each stream has its own sequence numbers, so a dropped frame shows up as a gap.
+// If the queue is full, a frame is dropped when canDrop is set, otherwise the client is too slow and is disconnected.
+func (c *client) send(msgType, streamType uint32, body []byte, canDrop bool) {
+	c.sendMtx.Lock()
+	defer c.sendMtx.Unlock()
+
+	var msg = wire.AppendMessage(nil, wire.MessageHeader{
+		ProtocolID:     wire.ProtocolVersion,
+		MessageType:    msgType,
+		StreamType:     streamType,
+		SequenceNumber: c.sequence[streamType],
+		BodySize:       uint32(len(body)),
+	}, body)
+	c.sequence[streamType]++
+
+	select {
+	case c.queue <- msg:
+	default:
+		if !canDrop {
+			log.Printf("Client %q is too slow, disconnecting\n", c.name)
+			c.close()
+		}
+	}
+}
+
+// setSetting handles the settings that only affect this client
+func (c *client) setSetting(setting, value uint32) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	switch setting {
+	case wire.SettingStreamingMode:
+		c.mode = value
+	case wire.SettingStreamingEnabled:
+		c.streaming = value != 0
+	case wire.SettingIqFormat:
+		switch value {
+		case wire.StreamFormatUint8, wire.StreamFormatInt16, wire.StreamFormatFloat:
+			if c.server.info.ForcedIQFormat == 0 {
+				c.iqFormat = value
+			}
+		}
+	case wire.SettingFFTFormat:
+		// Only 8 bit bins are supported
+	case wire.SettingFFTDbOffset:
+		c.fft.offsetDB = int32(value)
+	case wire.SettingFFTDbRange:
+		c.fft.rangeDB = int32(max(minDbRange, min(maxDbRange, value)))
+	case wire.SettingFFTDisplayPixels:
+		c.fft.pixels = max(minDisplayPixels, min(maxDisplayPixels, value))
+	}
+}
+
+// getSetting returns the value of a setting of this client
+func (c *client) getSetting(setting uint32) (uint32, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	switch setting {
+	case wire.SettingStreamingMode:
+		return c.mode, true
+	case wire.SettingStreamingEnabled:
+		if c.streaming {
+			return 1, true
+		}
+		return 0, true
+	case wire.SettingIqFormat:
+		return c.iqFormat, true
+	case wire.SettingIqFrequency:
+		return c.iq.frequency, true
+	case wire.SettingIqDecimation:
+		return c.iq.stage, true
+	case wire.SettingFFTFormat:
+		return c.fftFormat, true
+	case wire.SettingFFTFrequency:
+		return c.fft.frequency, true
+	case wire.SettingFFTDecimation:
+		return c.fft.stage, true
+	case wire.SettingFFTDbOffset:
+		return uint32(c.fft.offsetDB), true
+	case wire.SettingFFTDbRange:
+		return uint32(c.fft.rangeDB), true
+	case wire.SettingFFTDisplayPixels:
+		return c.fft.pixels, true
+	}
+
+	return 0, false
+}
+
+// process sends the IQ and FFT frames of a block of device samples
+func (c *client) process(samples []complex64, deviceFrequency uint32, sampleRate float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.streaming {
+		return
+	}
+
+	if c.mode&wire.StreamTypeIQ != 0 {
+		var offset = float64(int64(c.iq.frequency) - int64(deviceFrequency))
+		if out := c.iq.process(samples, offset, sampleRate); len(out) > 0 {
+			c.send(iqMessageType(c.iqFormat), wire.StreamTypeIQ, encodeIQ(out, c.iqFormat), true)
+		}
+	}
+
+	if c.mode&wire.StreamTypeFFT != 0 {
+		var offset = float64(int64(c.fft.frequency) - int64(deviceFrequency))
+		c.fft.process(samples, offset, sampleRate, func(bins []uint8) {
+			c.send(wire.MsgTypeUint8FFT, wire.StreamTypeFFT, bins, true)
+		})
+	}
+}
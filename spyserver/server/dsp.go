@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"math"
+	"math/cmplx"
+)
+
+// fftFrameRate is the number of FFT frames sent per second
+const fftFrameRate = 20
+
+// channel shifts a part of the device band to baseband and decimates it by 2^stage.
+// The decimation filter is a moving average, which is cheap but lets some aliasing through.
+type channel struct {
+	frequency uint32
+	stage     uint32
+	phase     complex128
+	acc       complex128
+	count     int
+	out       []complex64
+}
+
+// setStage changes the decimation, dropping the partially decimated sample
+func (ch *channel) setStage(stage uint32) {
+	ch.stage = stage
+	ch.acc = 0
+	ch.count = 0
+}
+
+// process returns the decimated channel of in, which is at sampleRate and offset Hz away from the channel.
+// The returned slice is reused by the next call.
+func (ch *channel) process(in []complex64, offset, sampleRate float64) []complex64 {
+	var step = cmplx.Exp(complex(0, -2*math.Pi*offset/sampleRate))
+	var factor = 1 << ch.stage
+
+	if ch.phase == 0 {
+		ch.phase = 1
+	}
+
+	ch.out = ch.out[:0]
+	for _, s := range in {
+		ch.acc += complex128(s) * ch.phase
+		ch.phase *= step
+		ch.count++
+		if ch.count == factor {
+			ch.out = append(ch.out, complex64(ch.acc/complex(float64(factor), 0)))
+			ch.acc = 0
+			ch.count = 0
+		}
+	}
+
+	// Keeps the oscillator on the unit circle
+	ch.phase /= complex(cmplx.Abs(ch.phase), 0)
+
+	return ch.out
+}
+
+// spectrum computes the FFT frames of a channel
+type spectrum struct {
+	channel
+	pixels   uint32
+	offsetDB int32
+	rangeDB  int32
+
+	ring      []complex64
+	pos       int
+	filled    int
+	sinceLast int
+	window    []float64
+	gain      float64
+	buf       []complex128
+}
+
+// fftSize returns the smallest power of two with at least one bin per pixel
+func fftSize(pixels uint32) int {
+	var n = 1
+	for n < int(pixels) {
+		n <<= 1
+	}
+	return n
+}
+
+// resize prepares the buffers for the current number of pixels
+func (sp *spectrum) resize() {
+	var n = fftSize(sp.pixels)
+	if len(sp.ring) == n {
+		return
+	}
+
+	sp.ring = make([]complex64, n)
+	sp.buf = make([]complex128, n)
+	sp.window = make([]float64, n)
+	sp.gain = 0
+	for i := range sp.window {
+		// Hann window
+		sp.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n))
+		sp.gain += sp.window[i]
+	}
+	sp.pos = 0
+	sp.filled = 0
+	sp.sinceLast = 0
+}
+
+// process feeds the samples of the device band to the spectrum, calling emit with each new frame.
+// The bins are reused after emit returns.
+func (sp *spectrum) process(in []complex64, offset, sampleRate float64, emit func(bins []uint8)) {
+	sp.resize()
+
+	var n = len(sp.ring)
+	var hop = max(1, int(sampleRate)>>sp.stage/fftFrameRate)
+
+	for _, s := range sp.channel.process(in, offset, sampleRate) {
+		sp.ring[sp.pos] = s
+		sp.pos = (sp.pos + 1) % n
+		sp.filled = min(sp.filled+1, n)
+		sp.sinceLast++
+
+		if sp.filled == n && sp.sinceLast >= hop {
+			sp.sinceLast = 0
+			emit(sp.frame())
+		}
+	}
+}
+
+// frame computes the FFT of the last samples and scales it to 8 bit pixels.
+// Each pixel is the strongest bin it covers, with the dB range mapped to 0..255.
+func (sp *spectrum) frame() []uint8 {
+	var n = len(sp.ring)
+	for i := range sp.buf {
+		sp.buf[i] = complex128(sp.ring[(sp.pos+i)%n]) * complex(sp.window[i], 0)
+	}
+	fft(sp.buf)
+
+	var bins = make([]uint8, sp.pixels)
+	var bottom = float64(sp.offsetDB - sp.rangeDB)
+	var scale = 255 / float64(sp.rangeDB)
+	var norm = sp.gain * sp.gain
+
+	for p := range bins {
+		var first = p * n / len(bins)
+		var last = max(first+1, (p+1)*n/len(bins))
+		var power = 0.0
+		for k := first; k < last; k++ {
+			// Negative frequencies first
+			var v = sp.buf[(k+n/2)%n]
+			power = max(power, real(v)*real(v)+imag(v)*imag(v))
+		}
+
+		var db = 10 * math.Log10(power/norm+1e-20)
+		bins[p] = uint8(max(0, min(255, (db-bottom)*scale)))
+	}
+
+	return bins
+}
+
+// fft is an in place radix 2 FFT. The length of x must be a power of two.
+func fft(x []complex128) {
+	var n = len(x)
+
+	for i, j := 1, 0; i < n; i++ {
+		var bit = n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		var step = cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			var w = complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				var a = x[start+k]
+				var b = x[start+k+size/2] * w
+				x[start+k] = a + b
+				x[start+k+size/2] = a - b
+				w *= step
+			}
+		}
+	}
+}
+
+// iqMessageType returns the message type of an IQ format
+func iqMessageType(format uint32) uint32 {
+	switch format {
+	case wire.StreamFormatUint8:
+		return wire.MsgTypeUint8IQ
+	case wire.StreamFormatFloat:
+		return wire.MsgTypeFloatIQ
+	}
+	return wire.MsgTypeInt16IQ
+}
+
+// encodeIQ converts the samples to an IQ format
+func encodeIQ(samples []complex64, format uint32) []byte {
+	switch format {
+	case wire.StreamFormatUint8:
+		var b = make([]byte, 0, len(samples)*2)
+		for _, s := range samples {
+			b = append(b, toUint8(real(s)), toUint8(imag(s)))
+		}
+		return b
+	case wire.StreamFormatFloat:
+		var b = make([]byte, 0, len(samples)*8)
+		for _, s := range samples {
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(real(s)))
+			b = binary.LittleEndian.AppendUint32(b, math.Float32bits(imag(s)))
+		}
+		return b
+	}
+
+	var b = make([]byte, 0, len(samples)*4)
+	for _, s := range samples {
+		b = binary.LittleEndian.AppendUint16(b, uint16(toInt16(real(s))))
+		b = binary.LittleEndian.AppendUint16(b, uint16(toInt16(imag(s))))
+	}
+	return b
+}
+
+func toUint8(v float32) uint8 {
+	return uint8(max(0, min(255, v*127.5+127.5)))
+}
+
+func toInt16(v float32) int16 {
+	return int16(max(-32768, min(32767, v*32767)))
+}
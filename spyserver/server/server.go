@@ -0,0 +1,380 @@
+// Package server implements a spyserver compatible server, streaming a Source to clients like SDR# or spyserver.Spyserver.
+//
+// The first client to connect controls the device: its IQ frequency tunes the device and it sets the gain.
+// The other clients tune their IQ and FFT channels inside the band of the device.
+// Each client gets its own IQ and FFT streams, shifted and decimated from the samples of the source.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close is called.
+var ErrServerClosed = errors.New("spyserver: server closed")
+
+// DefaultHelloTimeout is the time a new client has to send its hello, unless changed with SetHelloTimeout
+const DefaultHelloTimeout = 10 * time.Second
+
+// maxBlockSamples limits the samples read from the source at once, so a Float IQ message fits in MaxMessageBodySize
+const maxBlockSamples = 1 << 16
+
+// Server streams a Source to spyserver clients. Use New to create one.
+type Server struct {
+	source Source
+	info   wire.DeviceInfo
+
+	mtx             sync.Mutex
+	listener        net.Listener
+	clients         []*client
+	deviceFrequency uint32
+	gain            uint32
+	helloTimeout    time.Duration
+	closed          bool
+	done            chan struct{}
+	err             error
+}
+
+// New creates a server for source, which is tuned to frequency and gain when serving starts.
+func New(source Source, frequency, gain uint32) *Server {
+	var info = source.Info()
+	return &Server{
+		source:          source,
+		info:            info,
+		deviceFrequency: max(info.MinimumFrequency, min(info.MaximumFrequency, frequency)),
+		gain:            min(gain, info.MaximumGainIndex),
+		helloTimeout:    DefaultHelloTimeout,
+		done:            make(chan struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts clients on l and streams the source to them.
+// It blocks until Close is called, returning ErrServerClosed, or until the source or the listener fail.
+// Serve may be called only once.
+func (s *Server) Serve(l net.Listener) error {
+	s.mtx.Lock()
+	if s.closed || s.listener != nil {
+		s.mtx.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	s.mtx.Unlock()
+
+	if err := s.source.SetCenterFrequency(s.deviceFrequency); err != nil {
+		s.Close()
+		return fmt.Errorf("spyserver: tuning the source: %w", err)
+	}
+	if err := s.source.SetGain(s.gain); err != nil {
+		s.Close()
+		return fmt.Errorf("spyserver: setting the source gain: %w", err)
+	}
+
+	go s.readSource()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			if s.err != nil {
+				return s.err
+			}
+			if s.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go newClient(s, conn).serve()
+	}
+}
+
+// SetHelloTimeout sets the time a new client has to send its hello before it is disconnected.
+// Zero waits forever.
+func (s *Server) SetHelloTimeout(timeout time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.helloTimeout = timeout
+}
+
+func (s *Server) getHelloTimeout() time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.helloTimeout
+}
+
+// Addr returns the address the server is listening on, or nil if it isn't serving.
+func (s *Server) Addr() net.Addr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the server and disconnects all clients. It is safe to call Close more than once.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var clients = s.clients
+	s.clients = nil
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mtx.Unlock()
+
+	for _, c := range clients {
+		c.close()
+	}
+
+	return err
+}
+
+// fail stops the server because the source failed
+func (s *Server) fail(err error) {
+	s.mtx.Lock()
+	s.err = fmt.Errorf("spyserver: reading the source: %w", err)
+	s.mtx.Unlock()
+	s.Close()
+}
+
+// readSource feeds the samples of the source to the clients until the server is closed
+func (s *Server) readSource() {
+	var samples = make([]complex64, max(1024, min(maxBlockSamples, s.info.MaximumSampleRate/100)))
+	var sampleRate = float64(s.info.MaximumSampleRate)
+
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		n, err := s.source.Read(samples)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		s.mtx.Lock()
+		var clients = s.clients
+		var frequency = s.deviceFrequency
+		s.mtx.Unlock()
+
+		for _, c := range clients {
+			c.process(samples[:n], frequency, sampleRate)
+		}
+	}
+}
+
+// register adds a client after the hello, sending it the device info and the synchronization info
+func (s *Server) register(c *client) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	// Copy on write, readSource iterates over the old slice without the lock
+	s.clients = append(s.clients[:len(s.clients):len(s.clients)], c)
+
+	c.mtx.Lock()
+	c.iq.frequency = s.deviceFrequency
+	c.fft.frequency = s.deviceFrequency
+	c.mtx.Unlock()
+
+	c.send(wire.MsgTypeDeviceInfo, wire.StreamTypeStatus, s.info.Append(nil), false)
+	s.sendSync(c)
+
+	return true
+}
+
+// unregister removes a client, handing the control of the device to the next one
+func (s *Server) unregister(c *client) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i, other := range s.clients {
+		if other != c {
+			continue
+		}
+
+		var clients = make([]*client, 0, len(s.clients)-1)
+		clients = append(clients, s.clients[:i]...)
+		s.clients = append(clients, s.clients[i+1:]...)
+
+		if i == 0 && len(s.clients) > 0 {
+			s.sendSync(s.clients[0])
+		}
+		return
+	}
+}
+
+// controls returns true if the client controls the device. Must be called with mtx held.
+func (s *Server) controls(c *client) bool {
+	return len(s.clients) > 0 && s.clients[0] == c
+}
+
+// band returns the channel center frequencies inside the device band for a decimation stage.
+// Must be called with mtx held.
+func (s *Server) band(stage uint32) (uint32, uint32) {
+	var bandwidth = s.info.MaximumBandwidth >> stage
+	var span = (s.info.MaximumBandwidth - bandwidth) / 2
+	return s.deviceFrequency - min(span, s.deviceFrequency), s.deviceFrequency + span
+}
+
+// iqLimits returns the IQ center frequencies a client may ask for.
+// The controlling client retunes the device, so it may use the whole range of the device.
+// Must be called with mtx and c.mtx held.
+func (s *Server) iqLimits(c *client) (uint32, uint32) {
+	if s.controls(c) {
+		return s.info.MinimumFrequency, s.info.MaximumFrequency
+	}
+	return s.band(c.iq.stage)
+}
+
+// sendSync sends the synchronization info to a client. Must be called with mtx held.
+func (s *Server) sendSync(c *client) {
+	c.mtx.Lock()
+	var minIQ, maxIQ = s.iqLimits(c)
+	var minFFT, maxFFT = s.band(c.fft.stage)
+	var sync = wire.ClientSync{
+		Gain:                      s.gain,
+		DeviceCenterFrequency:     s.deviceFrequency,
+		IQCenterFrequency:         c.iq.frequency,
+		FFTCenterFrequency:        c.fft.frequency,
+		MinimumIQCenterFrequency:  minIQ,
+		MaximumIQCenterFrequency:  maxIQ,
+		MinimumFFTCenterFrequency: minFFT,
+		MaximumFFTCenterFrequency: maxFFT,
+	}
+	c.mtx.Unlock()
+
+	if s.controls(c) {
+		sync.CanControl = 1
+	}
+
+	c.send(wire.MsgTypeClientSync, wire.StreamTypeStatus, sync.Append(nil), false)
+}
+
+// clamp moves the channels of a client back inside their limits. Must be called with mtx and c.mtx held.
+func (s *Server) clamp(c *client) {
+	var lo, hi = s.iqLimits(c)
+	c.iq.frequency = max(lo, min(hi, c.iq.frequency))
+	lo, hi = s.band(c.fft.stage)
+	c.fft.frequency = max(lo, min(hi, c.fft.frequency))
+}
+
+// tune retunes the device to the IQ frequency of the controlling client, moving the channels of all clients
+// inside the new band. Must be called with mtx held.
+func (s *Server) tune(frequency uint32) {
+	if err := s.source.SetCenterFrequency(frequency); err != nil {
+		log.Printf("Error tuning the source to %d Hz: %s\n", frequency, err)
+		s.sendSync(s.clients[0])
+		return
+	}
+
+	s.deviceFrequency = frequency
+	for i, c := range s.clients {
+		c.mtx.Lock()
+		if i == 0 {
+			c.iq.frequency = frequency
+		}
+		s.clamp(c)
+		c.mtx.Unlock()
+		s.sendSync(c)
+	}
+}
+
+// setGain sets the device gain and tells all clients. Must be called with mtx held.
+func (s *Server) setGain(gain uint32) {
+	if err := s.source.SetGain(gain); err != nil {
+		log.Printf("Error setting the source gain to %d: %s\n", gain, err)
+		return
+	}
+
+	s.gain = gain
+	for _, c := range s.clients {
+		s.sendSync(c)
+	}
+}
+
+// setSetting handles a CmdSetSetting from a client
+func (s *Server) setSetting(c *client, setting, value uint32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch setting {
+	case wire.SettingGain:
+		if !s.controls(c) {
+			s.sendSync(c)
+			return
+		}
+		s.setGain(min(value, s.info.MaximumGainIndex))
+	case wire.SettingIqFrequency:
+		if s.controls(c) {
+			s.tune(max(s.info.MinimumFrequency, min(s.info.MaximumFrequency, value)))
+			return
+		}
+		c.mtx.Lock()
+		c.iq.frequency = value
+		s.clamp(c)
+		c.mtx.Unlock()
+		s.sendSync(c)
+	case wire.SettingFFTFrequency:
+		c.mtx.Lock()
+		c.fft.frequency = value
+		s.clamp(c)
+		c.mtx.Unlock()
+		s.sendSync(c)
+	case wire.SettingIqDecimation, wire.SettingFFTDecimation:
+		if value >= s.info.DecimationStageCount {
+			return
+		}
+		c.mtx.Lock()
+		if setting == wire.SettingIqDecimation {
+			c.iq.setStage(max(value, s.info.MinimumIQDecimation))
+		} else {
+			c.fft.setStage(value)
+		}
+		s.clamp(c)
+		c.mtx.Unlock()
+		s.sendSync(c)
+	default:
+		c.setSetting(setting, value)
+	}
+}
+
+// getSetting returns the value of a setting for a client
+func (s *Server) getSetting(c *client, setting uint32) (uint32, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if setting == wire.SettingGain {
+		return s.gain, true
+	}
+
+	return c.getSetting(setting)
+}
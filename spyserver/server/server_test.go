@@ -0,0 +1,407 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/racerxdl/spy2go/spyserver"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"github.com/racerxdl/spy2go/spytypes"
+	"math"
+	"math/cmplx"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testSampleRate = 1000000
+	testToneOffset = 100000
+)
+
+var testInfo = wire.DeviceInfo{
+	DeviceType:           spyserver.DeviceAirspyOne,
+	DeviceSerial:         0x1234,
+	MaximumSampleRate:    testSampleRate,
+	MaximumBandwidth:     800000,
+	DecimationStageCount: 6,
+	GainStageCount:       21,
+	MaximumGainIndex:     21,
+	MinimumFrequency:     24000000,
+	MaximumFrequency:     1800000000,
+	Resolution:           12,
+}
+
+// toneSource generates a tone testToneOffset Hz above its center frequency, paced in real time
+type toneSource struct {
+	mtx       sync.Mutex
+	frequency uint32
+	gain      uint32
+	phase     float64
+	err       error
+}
+
+func (ts *toneSource) Info() wire.DeviceInfo {
+	return testInfo
+}
+
+func (ts *toneSource) SetCenterFrequency(frequency uint32) error {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	ts.frequency = frequency
+	return nil
+}
+
+func (ts *toneSource) SetGain(gain uint32) error {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	ts.gain = gain
+	return nil
+}
+
+func (ts *toneSource) Read(samples []complex64) (int, error) {
+	time.Sleep(time.Duration(len(samples)) * time.Second / testSampleRate)
+
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	if ts.err != nil {
+		return 0, ts.err
+	}
+
+	for i := range samples {
+		samples[i] = complex64(cmplx.Rect(0.5, ts.phase))
+		ts.phase = math.Mod(ts.phase+2*math.Pi*testToneOffset/testSampleRate, 2*math.Pi)
+	}
+	return len(samples), nil
+}
+
+func (ts *toneSource) Get() (uint32, uint32) {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	return ts.frequency, ts.gain
+}
+
+// startServer serves a toneSource on a random local port
+func startServer(t *testing.T) (string, *toneSource) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var source = &toneSource{}
+	var s = New(source, 100000000, 10)
+	var served = make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	})
+
+	return l.Addr().String(), source
+}
+
+func connect(t *testing.T, addr string) *spyserver.Spyserver {
+	t.Helper()
+	var c = spyserver.MakeSpyserverByFullHS(addr)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Disconnect)
+	return c
+}
+
+// toneFrequency estimates the frequency of a tone from the average phase step between samples
+func toneFrequency(samples []complex64, sampleRate uint32) float64 {
+	var sum complex128
+	for i := 1; i < len(samples); i++ {
+		sum += complex128(samples[i] * complex(real(samples[i-1]), -imag(samples[i-1])))
+	}
+	return cmplx.Phase(sum) * float64(sampleRate) / (2 * math.Pi)
+}
+
+func waitIQ(t *testing.T, iq <-chan spytypes.SampleBlock) spytypes.SampleBlock {
+	t.Helper()
+	select {
+	case block := <-iq:
+		return block
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for IQ samples")
+	}
+	return spytypes.SampleBlock{}
+}
+
+func TestConnectAndControl(t *testing.T) {
+	var addr, source = startServer(t)
+	var c = connect(t, addr)
+
+	if !c.CanControl() {
+		t.Fatal("expected the first client to control the device")
+	}
+	if c.DeviceInfo() != testInfo {
+		t.Fatalf("unexpected device info %+v", c.DeviceInfo())
+	}
+	if c.GetDeviceCenterFrequency() != 100000000 || c.GetGain() != 10 {
+		t.Fatalf("unexpected initial state %+v", c.LastSync())
+	}
+
+	sync, err := c.Apply(context.Background(),
+		spyserver.Change{Setting: spyserver.SettingIqFrequency, Value: 433000000},
+		spyserver.Change{Setting: spyserver.SettingGain, Value: 15},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sync.DeviceCenterFrequency != 433000000 || sync.IQCenterFrequency != 433000000 || sync.Gain != 15 {
+		t.Fatalf("unexpected sync %+v", sync)
+	}
+	if frequency, gain := source.Get(); frequency != 433000000 || gain != 15 {
+		t.Fatalf("source not tuned: %d Hz, gain %d", frequency, gain)
+	}
+
+	if err := c.SetDecimationStage(2); err != nil {
+		t.Fatal(err)
+	}
+	value, err := c.GetSettingFromServer(context.Background(), spyserver.SettingIqDecimation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 2 {
+		t.Fatalf("expected decimation stage 2, got %d", value)
+	}
+}
+
+func TestSecondClient(t *testing.T) {
+	var addr, source = startServer(t)
+	var first = connect(t, addr)
+	var second = connect(t, addr)
+
+	if second.CanControl() {
+		t.Fatal("expected the second client not to control the device")
+	}
+
+	// The second client tunes inside the device band without retuning it
+	if err := second.SetDecimationStage(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SetCenterFrequency(100000000 + testToneOffset); err != nil {
+		t.Fatal(err)
+	}
+	var deadline = time.Now().Add(2 * time.Second)
+	for second.LastSync().IQCenterFrequency != 100000000+testToneOffset {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected sync %+v", second.LastSync())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if second.GetDeviceCenterFrequency() != 100000000 {
+		t.Fatalf("unexpected device center frequency %d", second.GetDeviceCenterFrequency())
+	}
+	if frequency, _ := source.Get(); frequency != 100000000 {
+		t.Fatalf("source retuned to %d Hz", frequency)
+	}
+
+	// The tone is at the center of the channel
+	if err := second.SetIQFormat(spyserver.StreamFormatFloat); err != nil {
+		t.Fatal(err)
+	}
+	var iq = second.IQChannel(4, spytypes.OverflowDropOldest)
+	if err := second.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitIQ(t, iq)
+	var block = waitIQ(t, iq)
+	if f := toneFrequency(block.Complex64, block.SampleRate); math.Abs(f) > 1000 {
+		t.Fatalf("expected the tone at 0 Hz, got %.0f Hz", f)
+	}
+
+	// Control is handed over when the first client leaves
+	first.Disconnect()
+	deadline = time.Now().Add(2 * time.Second)
+	for !second.CanControl() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the second client to get control")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIQFormats(t *testing.T) {
+	var addr, _ = startServer(t)
+	var c = connect(t, addr)
+
+	if err := c.SetDecimationStage(1); err != nil {
+		t.Fatal(err)
+	}
+
+	var iq = c.IQChannel(4, spytypes.OverflowDropOldest)
+	for _, format := range []uint32{spyserver.StreamFormatUint8, spyserver.StreamFormatInt16, spyserver.StreamFormatFloat} {
+		if err := c.SetIQFormat(format); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		var samples []complex64
+		for len(samples) == 0 {
+			var block = waitIQ(t, iq)
+			if block.SampleRate != testSampleRate/2 {
+				t.Fatalf("unexpected sample rate %d", block.SampleRate)
+			}
+
+			switch format {
+			case spyserver.StreamFormatUint8:
+				for _, v := range block.ComplexUInt8 {
+					samples = append(samples, complex((float32(v.Real)-127.5)/127.5, (float32(v.Imag)-127.5)/127.5))
+				}
+			case spyserver.StreamFormatInt16:
+				for _, v := range block.ComplexInt16 {
+					samples = append(samples, complex(float32(v.Real)/32767, float32(v.Imag)/32767))
+				}
+			default:
+				samples = block.Complex64
+			}
+		}
+
+		if f := toneFrequency(samples, testSampleRate/2); math.Abs(f-testToneOffset) > 1000 {
+			t.Fatalf("format %d: expected the tone at %d Hz, got %.0f Hz", format, testToneOffset, f)
+		}
+
+		if err := c.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		for len(iq) > 0 {
+			<-iq
+		}
+	}
+}
+
+func TestFFT(t *testing.T) {
+	var addr, _ = startServer(t)
+	var c = connect(t, addr)
+
+	if err := c.SetStreamingMode(spyserver.StreamModeFFTOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetDisplayPixels(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	var fft = c.FFTChannel(1, spytypes.OverflowDropOldest)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case frame := <-fft:
+		if len(frame.Bins) != 1000 {
+			t.Fatalf("expected 1000 bins, got %d", len(frame.Bins))
+		}
+
+		var peak = 0
+		for i, v := range frame.Bins {
+			if v > frame.Bins[peak] {
+				peak = i
+			}
+		}
+
+		// The display is centered on the device frequency
+		var expected = int(1000 * (0.5 + testToneOffset/float64(uint32(testSampleRate)>>frame.DecimationStage)))
+		if peak < expected-2 || peak > expected+2 {
+			t.Fatalf("expected the peak at pixel %d, got %d", expected, peak)
+		}
+		if frame.Bins[100] > frame.Bins[peak]/2 {
+			t.Fatalf("expected a clean spectrum, got %d away from the peak of %d", frame.Bins[100], frame.Bins[peak])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for FFT frames")
+	}
+}
+
+func TestHelloVersion(t *testing.T) {
+	var addr, _ = startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(wire.AppendHello(nil, 3<<24, "test")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [wire.MessageHeaderSize]byte
+	if n, err := conn.Read(buf[:]); err == nil {
+		t.Fatalf("expected the connection to be closed, got %d bytes", n)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected the connection to be closed, timed out")
+	}
+}
+
+func TestHelloTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s = New(&toneSource{}, 100000000, 0)
+	s.SetHelloTimeout(50 * time.Millisecond)
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Never says hello
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buf [wire.MessageHeaderSize]byte
+	if n, err := conn.Read(buf[:]); err == nil {
+		t.Fatalf("expected the connection to be closed, got %d bytes", n)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("expected the connection to be closed, timed out")
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failure = errors.New("device unplugged")
+	var source = &toneSource{err: failure}
+	var s = New(source, 100000000, 0)
+
+	if err := s.Serve(l); !errors.Is(err, failure) {
+		t.Fatalf("expected the source error, got %v", err)
+	}
+}
+
+func TestEncodeIQ(t *testing.T) {
+	var samples = []complex64{complex(1, -1), complex(0, 2)}
+
+	if b := encodeIQ(samples, wire.StreamFormatUint8); string(b) != "\xff\x00\x7f\xff" {
+		t.Fatalf("unexpected Uint8 encoding %v", b)
+	}
+
+	var b = encodeIQ(samples, wire.StreamFormatInt16)
+	if int16(binary.LittleEndian.Uint16(b[0:])) != 32767 || int16(binary.LittleEndian.Uint16(b[2:])) != -32767 || int16(binary.LittleEndian.Uint16(b[6:])) != 32767 {
+		t.Fatalf("unexpected Int16 encoding %v", b)
+	}
+
+	b = encodeIQ(samples, wire.StreamFormatFloat)
+	if math.Float32frombits(binary.LittleEndian.Uint32(b[12:])) != 2 {
+		t.Fatalf("unexpected Float encoding %v", b)
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import "github.com/racerxdl/spy2go/spyserver/wire"
+
+// Source is the device served to the clients.
+// The server reads it continuously while serving, so Read should block until the samples are available,
+// which paces the streams sent to the clients.
+//
+// Implementations must be safe for concurrent use: Read is called by the reading goroutine,
+// while SetCenterFrequency and SetGain are called by the client goroutines, possibly during a Read.
+type Source interface {
+	// Info returns the device capabilities sent to the clients.
+	// MaximumSampleRate is the sample rate of Read and DecimationStageCount limits the decimation requested by the clients.
+	Info() wire.DeviceInfo
+	// SetCenterFrequency tunes the device, in Hz
+	SetCenterFrequency(frequency uint32) error
+	// SetGain sets the gain index, up to the MaximumGainIndex of Info
+	SetGain(gain uint32) error
+	// Read fills samples with IQ samples between -1 and 1 and returns how many were read.
+	Read(samples []complex64) (int, error)
+}
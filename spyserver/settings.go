@@ -0,0 +1,168 @@
+package spyserver
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+)
+
+// refreshOrder are the settings read by Refresh when no setting is given
+var refreshOrder = []uint32{
+	SettingStreamingMode,
+	SettingStreamingEnabled,
+	SettingGain,
+	SettingIqFormat,
+	SettingIqFrequency,
+	SettingIqDecimation,
+	SettingFFTFormat,
+	SettingFFTFrequency,
+	SettingFFTDecimation,
+	SettingFFTDbOffset,
+	SettingFFTDbRange,
+	SettingFFTDisplayPixels,
+}
+
+// processReadSetting delivers a msgTypeReadSetting reply to the oldest request for the same setting.
+// The body is the setting type followed by its value.
+func (f *Spyserver) processReadSetting() {
+	if len(f.bodyBuffer) < 8 {
+		f.decodeError()
+		return
+	}
+
+	var setting = binary.LittleEndian.Uint32(f.bodyBuffer[0:])
+	var value = binary.LittleEndian.Uint32(f.bodyBuffer[4:])
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var waiting = f.pendingReads[setting]
+	if len(waiting) == 0 {
+		return
+	}
+
+	waiting[0] <- value
+	if len(waiting) == 1 {
+		delete(f.pendingReads, setting)
+	} else {
+		f.pendingReads[setting] = waiting[1:]
+	}
+}
+
+// cancelReads fails all pending setting reads, because the connection is gone.
+// Must be called with mtx held.
+func (f *Spyserver) cancelReads() {
+	for setting, waiting := range f.pendingReads {
+		for _, c := range waiting {
+			close(c)
+		}
+		delete(f.pendingReads, setting)
+	}
+}
+
+// dropRead removes a pending read that is no longer waited for
+func (f *Spyserver) dropRead(setting uint32, c chan uint32) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var waiting = f.pendingReads[setting]
+	for i := range waiting {
+		if waiting[i] == c {
+			f.pendingReads[setting] = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(f.pendingReads[setting]) == 0 {
+		delete(f.pendingReads, setting)
+	}
+}
+
+// GetSettingFromServer reads the current value of a setting from the server, bypassing the cached values.
+// The setting is one of the Setting constants. It returns ErrNotConnected if the connection is lost before the reply.
+// The cached value is not updated, use Refresh for that.
+func (f *Spyserver) GetSettingFromServer(ctx context.Context, setting uint32) (uint32, error) {
+	var reply = make(chan uint32, 1)
+
+	f.mtx.Lock()
+	if !f.connected {
+		f.mtx.Unlock()
+		return 0, ErrNotConnected
+	}
+
+	if err := f.writeCommand(wire.AppendGetSetting(f.writeBuffer[:0], setting)); err != nil {
+		f.mtx.Unlock()
+		return 0, err
+	}
+	f.pendingReads[setting] = append(f.pendingReads[setting], reply)
+	f.mtx.Unlock()
+
+	select {
+	case value, ok := <-reply:
+		if !ok {
+			return 0, ErrNotConnected
+		}
+		return value, nil
+	case <-ctx.Done():
+		f.dropRead(setting, reply)
+		return 0, ctx.Err()
+	}
+}
+
+// Refresh reads the given settings from the server and updates the values returned by the getters,
+// like GetGain and GetCenterFrequency. Without settings, it reads all of them.
+// It doesn't change what is sent again after a reconnect.
+func (f *Spyserver) Refresh(ctx context.Context, settings ...uint32) error {
+	if len(settings) == 0 {
+		settings = refreshOrder
+	}
+
+	for _, setting := range settings {
+		value, err := f.GetSettingFromServer(ctx, setting)
+		if err != nil {
+			return err
+		}
+
+		f.mtx.Lock()
+		f.applyServerSetting(setting, value)
+		f.mtx.Unlock()
+	}
+
+	return nil
+}
+
+// applyServerSetting updates the cached value of a setting.
+// Must be called with mtx held.
+func (f *Spyserver) applyServerSetting(setting, value uint32) {
+	switch setting {
+	case SettingStreamingMode:
+		f.streamingMode = value
+	case SettingStreamingEnabled:
+		f.streaming = value != 0
+	case SettingGain:
+		f.gain = value
+	case SettingIqFormat:
+		f.iqFormat = value
+	case SettingIqFrequency:
+		f.channelCenterFrequency = value
+	case SettingIqDecimation:
+		f.channelDecimationStageCount = value
+		if value < uint32(len(f.sampleRates)) {
+			f.currentSampleRate = f.sampleRates[value].SampleRate
+		}
+	case SettingFFTFormat:
+		f.fftFormat = value
+	case SettingFFTFrequency:
+		f.displayCenterFrequency = value
+	case SettingFFTDecimation:
+		f.displayDecimationStageCount = value
+		if value < uint32(len(f.sampleRates)) {
+			f.currentDisplaySampleRate = f.sampleRates[value].SampleRate
+		}
+	case SettingFFTDbOffset:
+		f.displayOffset = int32(value)
+	case SettingFFTDbRange:
+		f.displayRange = int32(value)
+	case SettingFFTDisplayPixels:
+		f.displayPixels = value
+	}
+}
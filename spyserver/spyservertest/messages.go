@@ -0,0 +1,84 @@
+package spyservertest
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"math"
+)
+
+// IQMessage returns the message type and body of the synthetic IQ messages for a format.
+// Int16, Uint8 and Float send 256 samples counting from 0, Int24 sends 256 samples counting from -256000 in steps of 1000.
+func IQMessage(format uint32) (uint32, []byte) {
+	switch format {
+	case wire.StreamFormatUint8:
+		var body = make([]byte, 512)
+		for i := range body {
+			body[i] = uint8(i)
+		}
+		return wire.MsgTypeUint8IQ, body
+	case wire.StreamFormatFloat:
+		var body = make([]byte, 0, 512*4)
+		for i := 0; i < 512; i++ {
+			body = binary.LittleEndian.AppendUint32(body, math.Float32bits(float32(i)))
+		}
+		return wire.MsgTypeFloatIQ, body
+	case wire.StreamFormatInt24:
+		var body = make([]byte, 512*3)
+		for i := 0; i < 512; i++ {
+			var v = uint32(int32(i-256) * 1000)
+			body[i*3] = uint8(v)
+			body[i*3+1] = uint8(v >> 8)
+			body[i*3+2] = uint8(v >> 16)
+		}
+		return wire.MsgTypeInt24IQ, body
+	}
+
+	var body = make([]byte, 0, 512*2)
+	for i := 0; i < 512; i++ {
+		body = binary.LittleEndian.AppendUint16(body, uint16(i))
+	}
+	return wire.MsgTypeInt16IQ, body
+}
+
+// FFTBins returns the 256 bins carried by the synthetic FFT messages.
+// Bin i is (i % 16) * 0x11, so it survives the 4 bit packing.
+func FFTBins() []uint8 {
+	var bins = make([]uint8, 256)
+	for i := range bins {
+		bins[i] = uint8(i%16) * 0x11
+	}
+	return bins
+}
+
+// FFTMessage returns the message type and body of the synthetic FFT messages for a format, all carrying FFTBins.
+func FFTMessage(format uint32) (uint32, []byte) {
+	var bins = FFTBins()
+
+	switch format {
+	case wire.StreamFormatDint4:
+		var body = make([]byte, len(bins)/2)
+		for i := range body {
+			body[i] = bins[i*2]&0xF0 | bins[i*2+1]&0x0F
+		}
+		return wire.MsgTypeDint4FFT, body
+	case wire.StreamFormatCompressed:
+		var body bytes.Buffer
+		w, _ := flate.NewWriter(&body, flate.BestSpeed)
+		w.Write(bins)
+		w.Close()
+		return wire.MsgTypeCompressedFFT, body.Bytes()
+	}
+
+	return wire.MsgTypeUint8FFT, bins
+}
+
+// AFMessage returns the message type and body of the synthetic audio messages: 256 Int16 samples, sample i is i * 64
+func AFMessage() (uint32, []byte) {
+	var body = make([]byte, 0, 256*2)
+	for i := 0; i < 256; i++ {
+		body = binary.LittleEndian.AppendUint16(body, uint16(i*64))
+	}
+	return wire.MsgTypeInt16AF, body
+}
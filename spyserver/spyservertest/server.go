@@ -0,0 +1,562 @@
+// Package spyservertest provides a scripted spyserver for testing code built on spyserver.Spyserver,
+// in the spirit of net/http/httptest.
+//
+// The Server answers the handshake with a scripted device and synchronization info, keeps the
+// synchronization info in line with the settings sent by the clients and streams synthetic IQ, FFT
+// and audio while the streaming is enabled. Tests can open sequence gaps, refuse control, drop the
+// connections and inspect every command received.
+package spyservertest
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultDeviceInfo is the device announced by a new Server, an Airspy One
+var DefaultDeviceInfo = wire.DeviceInfo{
+	DeviceType:           wire.DeviceAirspyOne,
+	DeviceSerial:         0x1234,
+	MaximumSampleRate:    10000000,
+	MaximumBandwidth:     8000000,
+	DecimationStageCount: 8,
+	GainStageCount:       21,
+	MaximumGainIndex:     21,
+	MinimumFrequency:     24000000,
+	MaximumFrequency:     1800000000,
+	Resolution:           12,
+}
+
+// DefaultSync is the synchronization info of a new Server, with control granted
+var DefaultSync = wire.ClientSync{
+	CanControl:               1,
+	MinimumIQCenterFrequency: 24000000,
+	MaximumIQCenterFrequency: 1800000000,
+}
+
+// DefaultInterval is the time between the synthetic frames of each stream
+const DefaultInterval = time.Millisecond
+
+// Command is a command received from a client
+type Command struct {
+	// Type is the command type, one of the wire.Cmd constants
+	Type uint32
+	// Setting is the first word of the body, the setting of CmdGetSetting and CmdSetSetting
+	Setting uint32
+	// Value is the second word of the body, the value of CmdSetSetting
+	Value uint32
+	// Body is the command body as received
+	Body []byte
+}
+
+// Server is a scripted spyserver listening on the loopback interface.
+// All methods are safe for concurrent use.
+type Server struct {
+	// Addr is the host:port the server listens on, to be used with spyserver.MakeSpyserverByFullHS
+	Addr string
+
+	listener net.Listener
+
+	mtx           sync.Mutex
+	info          wire.DeviceInfo
+	sync          wire.ClientSync
+	version       uint32
+	interval      time.Duration
+	conns         []*conn
+	commands      []Command
+	values        map[uint32]uint32
+	silent        bool
+	ignorePings   bool
+	ignoreReads   bool
+	started       bool
+	commandSignal chan struct{}
+}
+
+// NewServer starts and returns a new Server. The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	var s = NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server that doesn't listen yet, so it can be scripted before Start.
+func NewUnstartedServer() *Server {
+	return &Server{
+		info:          DefaultDeviceInfo,
+		sync:          DefaultSync,
+		version:       wire.ProtocolVersion,
+		interval:      DefaultInterval,
+		values:        map[uint32]uint32{},
+		commandSignal: make(chan struct{}),
+	}
+}
+
+// Start starts a server from NewUnstartedServer. It panics if the server can't listen.
+func (s *Server) Start() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.started {
+		panic("spyservertest: Server already started")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("spyservertest: failed to listen on a port: %v", err))
+	}
+
+	s.started = true
+	s.listener = l
+	s.Addr = l.Addr().String()
+
+	go s.acceptLoop()
+}
+
+// Close stops listening and drops all connections.
+func (s *Server) Close() {
+	s.mtx.Lock()
+	var l = s.listener
+	s.mtx.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+	s.DropConnections()
+}
+
+// UpdateDeviceInfo changes the device info sent to the next clients.
+func (s *Server) UpdateDeviceInfo(fn func(info *wire.DeviceInfo)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	fn(&s.info)
+}
+
+// DeviceInfo returns the device info sent to the clients.
+func (s *Server) DeviceInfo() wire.DeviceInfo {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.info
+}
+
+// SetProtocolVersion changes the protocol version of the messages sent from now on.
+func (s *Server) SetProtocolVersion(version uint32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.version = version
+}
+
+// SetSilent makes the server skip the device and synchronization info when clients connect,
+// so their handshake never completes.
+func (s *Server) SetSilent(silent bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.silent = silent
+}
+
+// IgnorePings makes the server stop answering pings.
+func (s *Server) IgnorePings(ignore bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.ignorePings = ignore
+}
+
+// IgnoreReads makes the server stop answering CmdGetSetting.
+func (s *Server) IgnoreReads(ignore bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.ignoreReads = ignore
+}
+
+// SetInterval changes the time between the synthetic frames of the streams started from now on.
+func (s *Server) SetInterval(interval time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.interval = interval
+}
+
+// SetValue changes the value returned for a setting by CmdGetSetting, as if another client had changed it.
+// Each CmdSetSetting also updates it.
+func (s *Server) SetValue(setting, value uint32) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.values[setting] = value
+}
+
+// Sync returns the synchronization info sent to the clients.
+func (s *Server) Sync() wire.ClientSync {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sync
+}
+
+// UpdateSync changes the synchronization info and sends it to all clients.
+func (s *Server) UpdateSync(fn func(sync *wire.ClientSync)) {
+	s.mtx.Lock()
+	fn(&s.sync)
+	var body = s.sync.Append(nil)
+	var conns = s.conns
+	s.mtx.Unlock()
+
+	for _, c := range conns {
+		c.writeMessage(wire.MsgTypeClientSync, wire.StreamTypeStatus, body)
+	}
+}
+
+// RefuseControl takes the control of the device from the clients, or gives it back.
+// Without control, the gain and IQ frequency settings are ignored and the unchanged synchronization info is sent back.
+func (s *Server) RefuseControl(refuse bool) {
+	s.UpdateSync(func(sync *wire.ClientSync) {
+		sync.CanControl = 1
+		if refuse {
+			sync.CanControl = 0
+		}
+	})
+}
+
+// Send sends a message to all clients, using the next sequence number of the stream.
+func (s *Server) Send(msgType, streamType uint32, body []byte) error {
+	s.mtx.Lock()
+	var conns = s.conns
+	s.mtx.Unlock()
+
+	for _, c := range conns {
+		if err := c.writeMessage(msgType, streamType, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SkipSequence skips n sequence numbers of a stream on all connections, so the clients see a gap of n frames.
+func (s *Server) SkipSequence(streamType, n uint32) {
+	s.mtx.Lock()
+	var conns = s.conns
+	s.mtx.Unlock()
+
+	for _, c := range conns {
+		c.writeMtx.Lock()
+		c.sequence[streamType] += n
+		c.writeMtx.Unlock()
+	}
+}
+
+// Connections returns the number of connected clients.
+func (s *Server) Connections() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.conns)
+}
+
+// WaitConnections waits until n clients are connected.
+func (s *Server) WaitConnections(ctx context.Context, n int) error {
+	return s.wait(ctx, func() bool { return len(s.conns) >= n })
+}
+
+// DropConnections closes all client connections.
+func (s *Server) DropConnections() {
+	s.mtx.Lock()
+	var conns = s.conns
+	s.conns = nil
+	s.mtx.Unlock()
+
+	for _, c := range conns {
+		c.conn.Close()
+	}
+}
+
+// remove forgets a closed connection
+func (s *Server) remove(c *conn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i, other := range s.conns {
+		if other == c {
+			var conns = make([]*conn, 0, len(s.conns)-1)
+			s.conns = append(append(conns, s.conns[:i]...), s.conns[i+1:]...)
+			break
+		}
+	}
+	s.notify()
+}
+
+// Commands returns a copy of all commands received so far, from all clients.
+func (s *Server) Commands() []Command {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]Command(nil), s.commands...)
+}
+
+// LastSetting returns the last value received for a setting.
+func (s *Server) LastSetting(setting uint32) (uint32, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.lastSetting(setting)
+}
+
+func (s *Server) lastSetting(setting uint32) (uint32, bool) {
+	for i := len(s.commands) - 1; i >= 0; i-- {
+		if s.commands[i].Type == wire.CmdSetSetting && s.commands[i].Setting == setting {
+			return s.commands[i].Value, true
+		}
+	}
+	return 0, false
+}
+
+// WaitSetting waits until the last value received for a setting is value.
+func (s *Server) WaitSetting(ctx context.Context, setting, value uint32) error {
+	return s.wait(ctx, func() bool {
+		v, ok := s.lastSetting(setting)
+		return ok && v == value
+	})
+}
+
+// wait waits until cond, called with mtx held, returns true. It is checked again after each command.
+func (s *Server) wait(ctx context.Context, cond func() bool) error {
+	for {
+		s.mtx.Lock()
+		var done = cond()
+		var signal = s.commandSignal
+		s.mtx.Unlock()
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-signal:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify wakes up the waiters. Must be called with mtx held.
+func (s *Server) notify() {
+	close(s.commandSignal)
+	s.commandSignal = make(chan struct{})
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		var c = &conn{
+			server:    s,
+			conn:      nc,
+			sequence:  map[uint32]uint32{},
+			mode:      wire.StreamTypeIQ,
+			iqFormat:  wire.StreamFormatInt16,
+			fftFormat: wire.StreamFormatUint8,
+		}
+
+		s.mtx.Lock()
+		s.conns = append(s.conns[:len(s.conns):len(s.conns)], c)
+		s.notify()
+		var silent = s.silent
+		var info = s.info
+		var syncInfo = s.sync
+		s.mtx.Unlock()
+
+		if !silent {
+			c.writeMessage(wire.MsgTypeDeviceInfo, wire.StreamTypeStatus, info.Append(nil))
+			c.writeMessage(wire.MsgTypeClientSync, wire.StreamTypeStatus, syncInfo.Append(nil))
+		}
+
+		go c.readLoop()
+	}
+}
+
+// conn is a client connection
+type conn struct {
+	server    *Server
+	conn      net.Conn
+	writeMtx  sync.Mutex
+	sequence  map[uint32]uint32 // next sequence number of each stream type
+	streaming chan struct{}
+	mode      uint32
+	iqFormat  uint32
+	fftFormat uint32
+}
+
+func (c *conn) writeMessage(msgType, streamType uint32, body []byte) error {
+	c.server.mtx.Lock()
+	var version = c.server.version
+	c.server.mtx.Unlock()
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+
+	var msg = wire.AppendMessage(nil, wire.MessageHeader{
+		ProtocolID:     version,
+		MessageType:    msgType,
+		StreamType:     streamType,
+		SequenceNumber: c.sequence[streamType],
+		BodySize:       uint32(len(body)),
+	}, body)
+	c.sequence[streamType]++
+
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+func (c *conn) readLoop() {
+	defer c.server.remove(c)
+	defer c.stopStreaming()
+
+	var decoder = wire.NewDecoder(bufio.NewReader(c.conn))
+	for {
+		header, body, err := decoder.ReadCommand()
+		if err != nil {
+			return
+		}
+
+		var cmd = Command{Type: header.CommandType, Body: append([]byte(nil), body...)}
+		if len(body) >= 4 {
+			cmd.Setting = binary.LittleEndian.Uint32(body[0:])
+		}
+		if len(body) >= 8 {
+			cmd.Value = binary.LittleEndian.Uint32(body[4:])
+		}
+
+		var s = c.server
+		s.mtx.Lock()
+		s.commands = append(s.commands, cmd)
+		if cmd.Type == wire.CmdSetSetting {
+			s.values[cmd.Setting] = cmd.Value
+		}
+		var value = s.values[cmd.Setting]
+		var ignoreReads = s.ignoreReads
+		var ignorePings = s.ignorePings
+		s.notify()
+		s.mtx.Unlock()
+
+		switch cmd.Type {
+		case wire.CmdSetSetting:
+			c.applySetting(cmd.Setting, cmd.Value)
+		case wire.CmdGetSetting:
+			if !ignoreReads {
+				var reply = binary.LittleEndian.AppendUint32(nil, cmd.Setting)
+				c.writeMessage(wire.MsgTypeReadSetting, wire.StreamTypeStatus, binary.LittleEndian.AppendUint32(reply, value))
+			}
+		case wire.CmdPing:
+			if !ignorePings {
+				c.writeMessage(wire.MsgTypePong, wire.StreamTypeStatus, nil)
+			}
+		}
+	}
+}
+
+// applySetting follows a setting, answering the ones in the synchronization info with the updated info
+func (c *conn) applySetting(setting, value uint32) {
+	var s = c.server
+
+	switch setting {
+	case wire.SettingStreamingEnabled:
+		if value != 0 {
+			c.startStreaming()
+		} else {
+			c.stopStreaming()
+		}
+		return
+	case wire.SettingStreamingMode:
+		c.writeMtx.Lock()
+		c.mode = value
+		c.writeMtx.Unlock()
+		return
+	case wire.SettingIqFormat:
+		c.writeMtx.Lock()
+		c.iqFormat = value
+		c.writeMtx.Unlock()
+		return
+	case wire.SettingFFTFormat:
+		c.writeMtx.Lock()
+		c.fftFormat = value
+		c.writeMtx.Unlock()
+		return
+	case wire.SettingGain, wire.SettingIqFrequency, wire.SettingFFTFrequency:
+	default:
+		return
+	}
+
+	s.mtx.Lock()
+	switch {
+	case setting == wire.SettingFFTFrequency:
+		s.sync.FFTCenterFrequency = value
+	case s.sync.CanControl == 0:
+		// Refused, the unchanged info tells the client
+	case setting == wire.SettingGain:
+		s.sync.Gain = value
+	default:
+		value = max(s.sync.MinimumIQCenterFrequency, min(value, s.sync.MaximumIQCenterFrequency))
+		s.sync.IQCenterFrequency = value
+		s.sync.DeviceCenterFrequency = value
+	}
+	var body = s.sync.Append(nil)
+	s.mtx.Unlock()
+
+	c.writeMessage(wire.MsgTypeClientSync, wire.StreamTypeStatus, body)
+}
+
+func (c *conn) startStreaming() {
+	c.server.mtx.Lock()
+	var interval = c.server.interval
+	c.server.mtx.Unlock()
+
+	c.writeMtx.Lock()
+	if c.streaming != nil {
+		c.writeMtx.Unlock()
+		return
+	}
+	var stop = make(chan struct{})
+	c.streaming = stop
+	var mode = c.mode
+	var iqType, samples = IQMessage(c.iqFormat)
+	var fftType, bins = FFTMessage(c.fftFormat)
+	var afType, audio = AFMessage()
+	c.writeMtx.Unlock()
+
+	go func() {
+		var ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if mode&wire.StreamTypeIQ != 0 {
+				if err := c.writeMessage(iqType, wire.StreamTypeIQ, samples); err != nil {
+					return
+				}
+			}
+			if mode&wire.StreamTypeAF != 0 {
+				if err := c.writeMessage(afType, wire.StreamTypeAF, audio); err != nil {
+					return
+				}
+			}
+			if mode&wire.StreamTypeFFT != 0 {
+				if err := c.writeMessage(fftType, wire.StreamTypeFFT, bins); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (c *conn) stopStreaming() {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	if c.streaming != nil {
+		close(c.streaming)
+		c.streaming = nil
+	}
+}
@@ -0,0 +1,181 @@
+package spyservertest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/racerxdl/spy2go/spyserver/wire"
+	"net"
+	"testing"
+	"time"
+)
+
+// dial connects to the server and says hello, returning a decoder for the messages
+func dial(t *testing.T, s *Server) (net.Conn, *wire.Decoder) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write(wire.AppendHello(nil, wire.ProtocolVersion, "test")); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, wire.NewDecoder(bufio.NewReader(conn))
+}
+
+func read(t *testing.T, d *wire.Decoder, msgType uint32) []byte {
+	t.Helper()
+
+	header, body, err := d.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.MessageType != msgType {
+		t.Fatalf("expected message %d, got %d", msgType, header.MessageType)
+	}
+	return append([]byte(nil), body...)
+}
+
+func readSync(t *testing.T, d *wire.Decoder) wire.ClientSync {
+	t.Helper()
+	sync, err := wire.DecodeClientSync(read(t, d, wire.MsgTypeClientSync))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sync
+}
+
+func TestCommands(t *testing.T) {
+	var s = NewServer()
+	defer s.Close()
+
+	conn, d := dial(t, s)
+
+	info, err := wire.DecodeDeviceInfo(read(t, d, wire.MsgTypeDeviceInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info != DefaultDeviceInfo || readSync(t, d) != DefaultSync {
+		t.Fatalf("unexpected handshake %+v", info)
+	}
+
+	var commands []byte
+	commands = wire.AppendSetSetting(commands, wire.SettingGain, 7)
+	commands = wire.AppendGetSetting(commands, wire.SettingGain)
+	commands = wire.AppendPing(commands)
+	if _, err := conn.Write(commands); err != nil {
+		t.Fatal(err)
+	}
+
+	if sync := readSync(t, d); sync.Gain != 7 {
+		t.Fatalf("expected gain 7 in the sync, got %d", sync.Gain)
+	}
+	if reply := read(t, d, wire.MsgTypeReadSetting); !bytes.Equal(reply, []byte{wire.SettingGain, 0, 0, 0, 7, 0, 0, 0}) {
+		t.Fatalf("unexpected read setting reply %v", reply)
+	}
+	read(t, d, wire.MsgTypePong)
+
+	var received = s.Commands()
+	if len(received) != 4 {
+		t.Fatalf("expected 4 commands, got %+v", received)
+	}
+	if received[0].Type != wire.CmdHello || string(received[0].Body[4:]) != "test" {
+		t.Fatalf("unexpected hello %+v", received[0])
+	}
+	if received[1].Type != wire.CmdSetSetting || received[1].Setting != wire.SettingGain || received[1].Value != 7 {
+		t.Fatalf("unexpected set setting %+v", received[1])
+	}
+	if received[2].Type != wire.CmdGetSetting || received[3].Type != wire.CmdPing || len(received[3].Body) != 0 {
+		t.Fatalf("unexpected commands %+v", received[2:])
+	}
+}
+
+func TestRefuseControl(t *testing.T) {
+	var s = NewServer()
+	defer s.Close()
+
+	conn, d := dial(t, s)
+	read(t, d, wire.MsgTypeDeviceInfo)
+	readSync(t, d)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.WaitConnections(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	s.RefuseControl(true)
+	if sync := readSync(t, d); sync.CanControl != 0 {
+		t.Fatal("expected control to be refused")
+	}
+
+	if _, err := conn.Write(wire.AppendSetSetting(nil, wire.SettingIqFrequency, 100000000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WaitSetting(ctx, wire.SettingIqFrequency, 100000000); err != nil {
+		t.Fatal(err)
+	}
+	if sync := readSync(t, d); sync.IQCenterFrequency != 0 {
+		t.Fatalf("expected the frequency to be refused, got %d", sync.IQCenterFrequency)
+	}
+}
+
+func TestStreamingAndGaps(t *testing.T) {
+	var s = NewServer()
+	defer s.Close()
+
+	conn, d := dial(t, s)
+	read(t, d, wire.MsgTypeDeviceInfo)
+	readSync(t, d)
+
+	if _, err := conn.Write(wire.AppendSetSetting(nil, wire.SettingStreamingEnabled, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgType, samples = IQMessage(wire.StreamFormatInt16)
+	header, body, err := d.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.MessageType != msgType || header.StreamType != wire.StreamTypeIQ || !bytes.Equal(body, samples) {
+		t.Fatalf("unexpected IQ message %+v", header)
+	}
+
+	var last = header.SequenceNumber
+	s.SkipSequence(wire.StreamTypeIQ, 3)
+	for {
+		header, _, err := d.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.SequenceNumber == last+4 {
+			break
+		}
+		if header.SequenceNumber != last+1 {
+			t.Fatalf("expected a gap of 3 after %d, got %d", last, header.SequenceNumber)
+		}
+		last = header.SequenceNumber
+	}
+
+	s.DropConnections()
+	for {
+		_, _, err := d.ReadMessage()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("expected the connection to be dropped")
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.wait(ctx, func() bool { return len(s.conns) == 0 }); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,315 @@
+package spyserver
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	// statsWindow is the sliding window of the throughput
+	statsWindow = 5 * time.Second
+	// statsBuckets is the number of slots of the sliding window
+	statsBuckets = 20
+)
+
+// StreamStats are the counters of one stream.
+type StreamStats struct {
+	// Frames is the number of messages received
+	Frames uint64
+	// Bytes is the number of bytes received, including the message headers
+	Bytes uint64
+	// DroppedFrames is the number of messages missing from the sequence numbers.
+	// A sequence number that doesn't move forward restarts the tracking from there instead of counting a gap.
+	DroppedFrames uint64
+	// Gaps is the number of times the sequence numbers skipped one or more messages
+	Gaps uint64
+	// ChannelDrops is the number of frames discarded by the overflow policy of the channels
+	ChannelDrops uint64
+	// Throughput is the received bytes per second over the last few seconds
+	Throughput float64
+	// FrameRate is the received messages per second over the last few seconds
+	FrameRate float64
+}
+
+// Stats is a snapshot of the counters, returned by Stats and TotalStats.
+type Stats struct {
+	// IQ, AF and FFT are the counters of each stream
+	IQ  StreamStats
+	AF  StreamStats
+	FFT StreamStats
+	// Bytes is the number of bytes received, including the control messages
+	Bytes uint64
+	// Throughput is the received bytes per second over the last few seconds
+	Throughput float64
+	// MessagesByType is the number of messages received by message type
+	MessagesByType map[uint32]uint64
+	// DecodeErrors is the number of messages that couldn't be decoded
+	DecodeErrors uint64
+	// UnsupportedMessages is the number of messages of a type the client doesn't handle
+	UnsupportedMessages uint64
+	// Pongs is the number of keepalive pongs received
+	Pongs uint64
+}
+
+// accumulate adds the counters of other, keeping the rates of s
+func (s *StreamStats) accumulate(other StreamStats) {
+	s.Frames += other.Frames
+	s.Bytes += other.Bytes
+	s.DroppedFrames += other.DroppedFrames
+	s.Gaps += other.Gaps
+	s.ChannelDrops += other.ChannelDrops
+}
+
+// accumulate adds the counters of other, keeping the rates of s
+func (s *Stats) accumulate(other Stats) {
+	s.IQ.accumulate(other.IQ)
+	s.AF.accumulate(other.AF)
+	s.FFT.accumulate(other.FFT)
+	s.Bytes += other.Bytes
+	s.DecodeErrors += other.DecodeErrors
+	s.UnsupportedMessages += other.UnsupportedMessages
+	s.Pongs += other.Pongs
+	if s.MessagesByType == nil {
+		s.MessagesByType = make(map[uint32]uint64, len(other.MessagesByType))
+	}
+	for msgType, count := range other.MessagesByType {
+		s.MessagesByType[msgType] += count
+	}
+}
+
+// throughput measures a rate over a sliding window
+type throughput struct {
+	since       time.Time
+	bucketStart time.Time
+	head        int
+	buckets     [statsBuckets]uint64
+}
+
+// advance moves the window up to now, clearing the slots that expired
+func (t *throughput) advance(now time.Time) {
+	const bucketSize = statsWindow / statsBuckets
+
+	if t.since.IsZero() {
+		t.since = now
+		t.bucketStart = now
+		return
+	}
+
+	var steps = int(now.Sub(t.bucketStart) / bucketSize)
+	if steps <= 0 {
+		return
+	}
+
+	t.bucketStart = t.bucketStart.Add(time.Duration(steps) * bucketSize)
+	for i := 0; i < steps && i < statsBuckets; i++ {
+		t.head = (t.head + 1) % statsBuckets
+		t.buckets[t.head] = 0
+	}
+}
+
+func (t *throughput) add(now time.Time, n uint64) {
+	t.advance(now)
+	t.buckets[t.head] += n
+}
+
+// rate returns the units per second over the window, or over the time since the first add if shorter
+func (t *throughput) rate(now time.Time) float64 {
+	if t.since.IsZero() {
+		return 0
+	}
+	t.advance(now)
+
+	var elapsed = now.Sub(t.since)
+	if elapsed > statsWindow {
+		elapsed = statsWindow
+	}
+	if elapsed <= 0 {
+		return 0
+	}
+
+	var total uint64
+	for _, b := range t.buckets {
+		total += b
+	}
+	return float64(total) / elapsed.Seconds()
+}
+
+// streamCounters are the counters of one stream
+type streamCounters struct {
+	StreamStats
+	lastSequence uint32
+	started      bool
+	rate         throughput
+	frameRate    throughput
+}
+
+// add accounts a message, checking its sequence number
+func (c *streamCounters) add(now time.Time, sequence uint32, size uint64) {
+	if c.started {
+		switch {
+		case sequence <= c.lastSequence:
+			// Repeated, reordered or restarted numbering, not a gap
+		case sequence != c.lastSequence+1:
+			c.DroppedFrames += uint64(sequence - c.lastSequence - 1)
+			c.Gaps++
+		}
+	}
+	c.started = true
+	c.lastSequence = sequence
+	c.Frames++
+	c.Bytes += size
+	c.rate.add(now, size)
+	c.frameRate.add(now, 1)
+}
+
+// snapshot returns the counters with the current throughput
+func (c *streamCounters) snapshot(now time.Time) StreamStats {
+	var s = c.StreamStats
+	s.Throughput = c.rate.rate(now)
+	s.FrameRate = c.frameRate.rate(now)
+	return s
+}
+
+// connStats are the counters of a connection
+type connStats struct {
+	iq, af, fft    streamCounters
+	bytes          uint64
+	rate           throughput
+	messagesByType map[uint32]uint64
+	decodeErrors   uint64
+	unsupported    uint64
+	pongs          uint64
+}
+
+func newConnStats() *connStats {
+	return &connStats{messagesByType: map[uint32]uint64{}}
+}
+
+// stream returns the counters of a stream type, or nil for the control messages
+func (s *connStats) stream(streamType uint32) *streamCounters {
+	switch streamType {
+	case StreamTypeIQ:
+		return &s.iq
+	case StreamTypeAF:
+		return &s.af
+	case StreamTypeFFT:
+		return &s.fft
+	}
+	return nil
+}
+
+// snapshot returns the counters with the current throughput, without the channel drops
+func (s *connStats) snapshot(now time.Time) Stats {
+	var stats = Stats{
+		IQ:                  s.iq.snapshot(now),
+		AF:                  s.af.snapshot(now),
+		FFT:                 s.fft.snapshot(now),
+		Bytes:               s.bytes,
+		Throughput:          s.rate.rate(now),
+		MessagesByType:      make(map[uint32]uint64, len(s.messagesByType)),
+		DecodeErrors:        s.decodeErrors,
+		UnsupportedMessages: s.unsupported,
+		Pongs:               s.pongs,
+	}
+	for msgType, count := range s.messagesByType {
+		stats.MessagesByType[msgType] = count
+	}
+	return stats
+}
+
+// accountMessage updates the counters with the current message.
+// Must be called by the goroutine that reads from the connection.
+func (f *Spyserver) accountMessage() {
+	var size = uint64(messageHeaderSize + f.header.BodySize)
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var s = f.stats
+	s.messagesByType[f.header.MessageType]++
+	if c := s.stream(f.header.StreamType); c != nil {
+		c.add(f.receivedAt, f.header.SequenceNumber, size)
+	}
+}
+
+// countingReader accounts the bytes read from the connection
+type countingReader struct {
+	r io.Reader
+	f *Spyserver
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.f.accountBytes(n)
+	}
+	return n, err
+}
+
+// accountBytes updates the byte counters with a read from the connection
+func (f *Spyserver) accountBytes(n int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.stats.bytes += uint64(n)
+	f.stats.rate.add(time.Now(), uint64(n))
+}
+
+// decodeError counts a message that couldn't be decoded
+func (f *Spyserver) decodeError() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.stats.decodeErrors++
+}
+
+// unsupportedMessage counts a message of a type the client doesn't handle
+func (f *Spyserver) unsupportedMessage() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.stats.unsupported++
+}
+
+// Stats returns the counters of the current connection, or of the last one if disconnected.
+func (f *Spyserver) Stats() Stats {
+	var now = time.Now()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var stats = f.stats.snapshot(now)
+	f.addChannelDrops(&stats)
+	return stats
+}
+
+// TotalStats returns the counters accumulated over all connections since the client was created.
+// Unlike Stats, they never go back on a reconnect. The throughput and frame rates are those of the current connection.
+func (f *Spyserver) TotalStats() Stats {
+	var now = time.Now()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var stats = f.stats.snapshot(now)
+	stats.accumulate(f.totals)
+	f.addChannelDrops(&stats)
+	return stats
+}
+
+// resetStats adds the counters of the last connection to the totals and starts new ones.
+// Must be called with mtx held.
+func (f *Spyserver) resetStats() {
+	f.totals.accumulate(f.stats.snapshot(time.Now()))
+	f.stats = newConnStats()
+}
+
+// addChannelDrops adds the frames discarded by the open channels. Must be called with mtx held.
+func (f *Spyserver) addChannelDrops(stats *Stats) {
+	for _, c := range f.iqChannels {
+		stats.IQ.ChannelDrops += c.Dropped()
+	}
+	for _, c := range f.afChannels {
+		stats.AF.ChannelDrops += c.Dropped()
+	}
+	for _, c := range f.fftChannels {
+		stats.FFT.ChannelDrops += c.Dropped()
+	}
+}
@@ -0,0 +1,89 @@
+package wire
+
+import (
+	"fmt"
+	"io"
+)
+
+// Decoder reads messages or commands from a stream.
+// The header and body buffers are reused, so reading doesn't allocate once the body buffer
+// has grown to the biggest message. It is not safe for concurrent use.
+type Decoder struct {
+	r      io.Reader
+	header [MessageHeaderSize]byte
+	body   []byte
+}
+
+// NewDecoder creates a Decoder that reads from r.
+// Each message takes at least two reads, so r should be buffered, like a bufio.Reader.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// bodyChunkSize is how much the body buffer grows before the data arrives.
+// A header can announce up to MaxMessageBodySize, so the buffer only grows further as the body is received.
+const bodyChunkSize = 64 * 1024
+
+// readBody reads a body of size bytes into the reused buffer
+func (d *Decoder) readBody(size uint32) ([]byte, error) {
+	var read uint32
+	for {
+		var end = size
+		if uint32(cap(d.body)) < size {
+			// Grows at most to twice what was received so far
+			end = min(size, max(read*2, bodyChunkSize))
+			if uint32(cap(d.body)) < end {
+				var grown = make([]byte, end)
+				copy(grown, d.body[:read])
+				d.body = grown
+			}
+			end = min(size, uint32(cap(d.body)))
+		}
+
+		if _, err := io.ReadFull(d.r, d.body[read:end]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		read = end
+
+		if read == size {
+			return d.body[:size], nil
+		}
+	}
+}
+
+// ReadMessage reads the next message sent by a server.
+// The body is only valid until the next call.
+// It returns io.EOF if the stream ends between two messages, and io.ErrUnexpectedEOF if it ends in the middle of one.
+func (d *Decoder) ReadMessage() (MessageHeader, []byte, error) {
+	if _, err := io.ReadFull(d.r, d.header[:MessageHeaderSize]); err != nil {
+		return MessageHeader{}, nil, err
+	}
+
+	h, _ := DecodeMessageHeader(d.header[:])
+	if h.BodySize > MaxMessageBodySize {
+		return h, nil, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, h.BodySize)
+	}
+
+	body, err := d.readBody(h.BodySize)
+	return h, body, err
+}
+
+// ReadCommand reads the next command sent by a client.
+// The body is only valid until the next call.
+// It returns io.EOF if the stream ends between two commands, and io.ErrUnexpectedEOF if it ends in the middle of one.
+func (d *Decoder) ReadCommand() (CommandHeader, []byte, error) {
+	if _, err := io.ReadFull(d.r, d.header[:CommandHeaderSize]); err != nil {
+		return CommandHeader{}, nil, err
+	}
+
+	h, _ := DecodeCommandHeader(d.header[:])
+	if h.BodySize > MaxCommandBodySize {
+		return h, nil, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, h.BodySize)
+	}
+
+	body, err := d.readBody(h.BodySize)
+	return h, body, err
+}
@@ -0,0 +1,86 @@
+package wire
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// chunkReader returns the data in reads of the sizes given by splits, cycling over them
+type chunkReader struct {
+	data   []byte
+	splits []byte
+	n      int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	var size = len(p)
+	if len(r.splits) > 0 {
+		size = min(size, int(r.splits[r.n%len(r.splits)])+1)
+		r.n++
+	}
+	size = min(size, len(r.data))
+
+	copy(p, r.data[:size])
+	r.data = r.data[size:]
+	return size, nil
+}
+
+type decodedMessage struct {
+	header MessageHeader
+	body   []byte
+}
+
+// decodeAll reads messages until the first error, checking that the body buffer doesn't grow beyond what was received
+func decodeAll(t *testing.T, r io.Reader, streamSize int) ([]decodedMessage, error) {
+	var d = NewDecoder(r)
+	var messages []decodedMessage
+
+	for {
+		h, body, err := d.ReadMessage()
+		if limit := max(bodyChunkSize, 2*streamSize); cap(d.body) > limit {
+			t.Fatalf("body buffer grew to %d bytes with a stream of %d bytes", cap(d.body), streamSize)
+		}
+		if err != nil {
+			return messages, err
+		}
+		if uint32(len(body)) != h.BodySize {
+			t.Fatalf("body has %d bytes, header announces %d", len(body), h.BodySize)
+		}
+		messages = append(messages, decodedMessage{h, append([]byte(nil), body...)})
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	var valid []byte
+	valid = AppendMessage(valid, MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypeDeviceInfo}, testInfo.Append(nil))
+	valid = AppendMessage(valid, MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypePong}, nil)
+	valid = AppendMessage(valid, MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypeInt16IQ, StreamType: StreamTypeIQ}, make([]byte, 1024))
+
+	f.Add(valid, []byte{0})
+	f.Add(valid, []byte{3, 19, 200})
+	f.Add(valid[:30], []byte{})
+	f.Add(AppendMessageHeader(nil, MessageHeader{BodySize: MaxMessageBodySize}), []byte{7})
+	f.Add(AppendMessageHeader(nil, MessageHeader{BodySize: MaxMessageBodySize + 1}), []byte{})
+
+	f.Fuzz(func(t *testing.T, stream, splits []byte) {
+		whole, wholeErr := decodeAll(t, bytes.NewReader(stream), len(stream))
+		chunked, chunkedErr := decodeAll(t, &chunkReader{data: stream, splits: splits}, len(stream))
+
+		if len(whole) != len(chunked) {
+			t.Fatalf("got %d messages from the whole stream and %d from chunks", len(whole), len(chunked))
+		}
+		for i := range whole {
+			if whole[i].header != chunked[i].header || !bytes.Equal(whole[i].body, chunked[i].body) {
+				t.Fatalf("message %d differs: %+v and %+v", i, whole[i].header, chunked[i].header)
+			}
+		}
+		if (wholeErr == nil) != (chunkedErr == nil) || (wholeErr != nil && wholeErr.Error() != chunkedErr.Error()) {
+			t.Fatalf("got %v from the whole stream and %v from chunks", wholeErr, chunkedErr)
+		}
+	})
+}
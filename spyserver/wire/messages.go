@@ -0,0 +1,213 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrBodyTooLarge is returned when a header announces a body bigger than the protocol allows.
+var ErrBodyTooLarge = errors.New("spyserver: message body too large")
+
+// ErrShortBody is returned when a body is too short for the structure it should hold.
+var ErrShortBody = errors.New("spyserver: message body too short")
+
+// MessageHeader is the header of every message sent by the server.
+type MessageHeader struct {
+	ProtocolID     uint32
+	MessageType    uint32
+	StreamType     uint32
+	SequenceNumber uint32
+	BodySize       uint32
+}
+
+// MessageHeaderSize is the encoded size of a MessageHeader
+const MessageHeaderSize = 20
+
+// CommandHeader is the header of every command sent by the client.
+type CommandHeader struct {
+	CommandType uint32
+	BodySize    uint32
+}
+
+// CommandHeaderSize is the encoded size of a CommandHeader
+const CommandHeaderSize = 8
+
+// DeviceInfo is the device capability info sent by spyserver on connection.
+type DeviceInfo struct {
+	// DeviceType is one of the Device constants
+	DeviceType uint32
+	// DeviceSerial is the serial number of the device
+	DeviceSerial uint32
+	// MaximumSampleRate is the device sample rate, before decimation
+	MaximumSampleRate uint32
+	// MaximumBandwidth is the usable bandwidth at the maximum sample rate
+	MaximumBandwidth uint32
+	// DecimationStageCount is the number of decimation stages
+	DecimationStageCount uint32
+	// GainStageCount is the number of gain stages
+	GainStageCount uint32
+	// MaximumGainIndex is the highest gain index accepted by the server
+	MaximumGainIndex uint32
+	// MinimumFrequency is the lowest tunable frequency, in Hz
+	MinimumFrequency uint32
+	// MaximumFrequency is the highest tunable frequency, in Hz
+	MaximumFrequency uint32
+	// Resolution is the ADC resolution, in bits
+	Resolution uint32
+	// MinimumIQDecimation is the lowest decimation stage allowed for the IQ channel
+	MinimumIQDecimation uint32
+	// ForcedIQFormat is the only IQ format allowed by the server, or zero if any format is allowed
+	ForcedIQFormat uint32
+}
+
+// DeviceInfoSize is the encoded size of a DeviceInfo
+const DeviceInfoSize = 48
+
+// ClientSync is the synchronization info sent by spyserver when the device state changes.
+type ClientSync struct {
+	// CanControl is not zero if this client can change the device settings
+	CanControl uint32
+	// Gain is the current gain index
+	Gain uint32
+	// DeviceCenterFrequency is the frequency the device is tuned to, in Hz
+	DeviceCenterFrequency uint32
+	// IQCenterFrequency is the center frequency of the IQ channel, in Hz
+	IQCenterFrequency uint32
+	// FFTCenterFrequency is the center frequency of the FFT, in Hz
+	FFTCenterFrequency uint32
+	// MinimumIQCenterFrequency is the lowest center frequency allowed for the IQ channel, in Hz
+	MinimumIQCenterFrequency uint32
+	// MaximumIQCenterFrequency is the highest center frequency allowed for the IQ channel, in Hz
+	MaximumIQCenterFrequency uint32
+	// MinimumFFTCenterFrequency is the lowest center frequency allowed for the FFT, in Hz
+	MinimumFFTCenterFrequency uint32
+	// MaximumFFTCenterFrequency is the highest center frequency allowed for the FFT, in Hz
+	MaximumFFTCenterFrequency uint32
+}
+
+// ClientSyncSize is the encoded size of a ClientSync
+const ClientSyncSize = 36
+
+// appendUint32s appends the values in little endian
+func appendUint32s(dst []byte, values ...uint32) []byte {
+	for _, v := range values {
+		dst = binary.LittleEndian.AppendUint32(dst, v)
+	}
+	return dst
+}
+
+// readUint32s fills the values from b, which must have 4 bytes per value
+func readUint32s(b []byte, values ...*uint32) {
+	for i, v := range values {
+		*v = binary.LittleEndian.Uint32(b[i*4:])
+	}
+}
+
+// AppendMessageHeader appends the encoded header to dst
+func AppendMessageHeader(dst []byte, h MessageHeader) []byte {
+	return appendUint32s(dst, h.ProtocolID, h.MessageType, h.StreamType, h.SequenceNumber, h.BodySize)
+}
+
+// DecodeMessageHeader decodes a header from the first MessageHeaderSize bytes of b
+func DecodeMessageHeader(b []byte) (MessageHeader, error) {
+	var h MessageHeader
+	if len(b) < MessageHeaderSize {
+		return h, fmt.Errorf("%w: message header has %d bytes", ErrShortBody, len(b))
+	}
+	readUint32s(b, &h.ProtocolID, &h.MessageType, &h.StreamType, &h.SequenceNumber, &h.BodySize)
+	return h, nil
+}
+
+// AppendMessage appends a message to dst. The BodySize of h is set from body.
+func AppendMessage(dst []byte, h MessageHeader, body []byte) []byte {
+	h.BodySize = uint32(len(body))
+	dst = AppendMessageHeader(dst, h)
+	return append(dst, body...)
+}
+
+// AppendCommandHeader appends the encoded header to dst
+func AppendCommandHeader(dst []byte, h CommandHeader) []byte {
+	return appendUint32s(dst, h.CommandType, h.BodySize)
+}
+
+// DecodeCommandHeader decodes a header from the first CommandHeaderSize bytes of b
+func DecodeCommandHeader(b []byte) (CommandHeader, error) {
+	var h CommandHeader
+	if len(b) < CommandHeaderSize {
+		return h, fmt.Errorf("%w: command header has %d bytes", ErrShortBody, len(b))
+	}
+	readUint32s(b, &h.CommandType, &h.BodySize)
+	return h, nil
+}
+
+// AppendCommand appends a command to dst
+func AppendCommand(dst []byte, cmd uint32, body []byte) []byte {
+	dst = AppendCommandHeader(dst, CommandHeader{CommandType: cmd, BodySize: uint32(len(body))})
+	return append(dst, body...)
+}
+
+// AppendHello appends a CmdHello with the protocol version and the software name to dst
+func AppendHello(dst []byte, version uint32, softwareID string) []byte {
+	dst = AppendCommandHeader(dst, CommandHeader{CommandType: CmdHello, BodySize: uint32(4 + len(softwareID))})
+	dst = binary.LittleEndian.AppendUint32(dst, version)
+	return append(dst, softwareID...)
+}
+
+// AppendSetSetting appends a CmdSetSetting to dst
+func AppendSetSetting(dst []byte, setting uint32, values ...uint32) []byte {
+	dst = AppendCommandHeader(dst, CommandHeader{CommandType: CmdSetSetting, BodySize: uint32(4 + 4*len(values))})
+	dst = binary.LittleEndian.AppendUint32(dst, setting)
+	return appendUint32s(dst, values...)
+}
+
+// AppendGetSetting appends a CmdGetSetting to dst
+func AppendGetSetting(dst []byte, setting uint32) []byte {
+	dst = AppendCommandHeader(dst, CommandHeader{CommandType: CmdGetSetting, BodySize: 4})
+	return binary.LittleEndian.AppendUint32(dst, setting)
+}
+
+// AppendPing appends a CmdPing to dst
+func AppendPing(dst []byte) []byte {
+	return AppendCommandHeader(dst, CommandHeader{CommandType: CmdPing})
+}
+
+// Append appends the encoded DeviceInfo to dst
+func (d DeviceInfo) Append(dst []byte) []byte {
+	return appendUint32s(dst,
+		d.DeviceType, d.DeviceSerial, d.MaximumSampleRate, d.MaximumBandwidth,
+		d.DecimationStageCount, d.GainStageCount, d.MaximumGainIndex, d.MinimumFrequency,
+		d.MaximumFrequency, d.Resolution, d.MinimumIQDecimation, d.ForcedIQFormat)
+}
+
+// DecodeDeviceInfo decodes the body of a MsgTypeDeviceInfo
+func DecodeDeviceInfo(body []byte) (DeviceInfo, error) {
+	var d DeviceInfo
+	if len(body) < DeviceInfoSize {
+		return d, fmt.Errorf("%w: device info has %d bytes", ErrShortBody, len(body))
+	}
+	readUint32s(body,
+		&d.DeviceType, &d.DeviceSerial, &d.MaximumSampleRate, &d.MaximumBandwidth,
+		&d.DecimationStageCount, &d.GainStageCount, &d.MaximumGainIndex, &d.MinimumFrequency,
+		&d.MaximumFrequency, &d.Resolution, &d.MinimumIQDecimation, &d.ForcedIQFormat)
+	return d, nil
+}
+
+// Append appends the encoded ClientSync to dst
+func (s ClientSync) Append(dst []byte) []byte {
+	return appendUint32s(dst,
+		s.CanControl, s.Gain, s.DeviceCenterFrequency, s.IQCenterFrequency, s.FFTCenterFrequency,
+		s.MinimumIQCenterFrequency, s.MaximumIQCenterFrequency, s.MinimumFFTCenterFrequency, s.MaximumFFTCenterFrequency)
+}
+
+// DecodeClientSync decodes the body of a MsgTypeClientSync
+func DecodeClientSync(body []byte) (ClientSync, error) {
+	var s ClientSync
+	if len(body) < ClientSyncSize {
+		return s, fmt.Errorf("%w: client sync has %d bytes", ErrShortBody, len(body))
+	}
+	readUint32s(body,
+		&s.CanControl, &s.Gain, &s.DeviceCenterFrequency, &s.IQCenterFrequency, &s.FFTCenterFrequency,
+		&s.MinimumIQCenterFrequency, &s.MaximumIQCenterFrequency, &s.MinimumFFTCenterFrequency, &s.MaximumFFTCenterFrequency)
+	return s, nil
+}
@@ -0,0 +1,100 @@
+// Package wire implements the spyserver wire protocol: the message and command framing,
+// the protocol constants and the fixed size structures exchanged by clients and servers.
+//
+// All values are little endian. A server sends messages, each one a MessageHeader followed by
+// BodySize bytes. A client sends commands, each one a CommandHeader followed by BodySize bytes.
+package wire
+
+// ProtocolVersion is the protocol version spoken by this package, packed into a integer.
+// Defined by ((major) << 24) | ((minor) << 16) | (revision)
+const ProtocolVersion = ((2) << 24) | ((0) << 16) | (1558)
+
+// MaxMessageBodySize is the biggest message body allowed by the protocol
+const MaxMessageBodySize = 1 << 20
+
+// MaxCommandBodySize is the biggest command body allowed by the protocol
+const MaxCommandBodySize = 256
+
+// Command types, sent by the client
+const (
+	CmdHello      = 0
+	CmdGetSetting = 1
+	CmdSetSetting = 2
+	CmdPing       = 3
+)
+
+// Setting types, used by CmdGetSetting, CmdSetSetting and MsgTypeReadSetting
+const (
+	SettingStreamingMode    = 0
+	SettingStreamingEnabled = 1
+	SettingGain             = 2
+
+	SettingIqFormat     = 100
+	SettingIqFrequency  = 101
+	SettingIqDecimation = 102
+
+	SettingFFTFormat        = 200
+	SettingFFTFrequency     = 201
+	SettingFFTDecimation    = 202
+	SettingFFTDbOffset      = 203
+	SettingFFTDbRange       = 204
+	SettingFFTDisplayPixels = 205
+)
+
+// Device types, sent in DeviceInfo
+const (
+	DeviceInvalid   = 0
+	DeviceAirspyOne = 1
+	DeviceAirspyHf  = 2
+	DeviceRtlsdr    = 3
+)
+
+// Stream types, used in the message header and combined in the streaming mode
+const (
+	StreamTypeStatus = 0
+	StreamTypeIQ     = 1
+	StreamTypeAF     = 2
+	StreamTypeFFT    = 4
+)
+
+// Stream formats, used by the format settings
+const (
+	// StreamFormatDint4 packs two 4 bit FFT bins per byte. FFT only.
+	StreamFormatDint4 = 0
+
+	StreamFormatUint8 = 1
+	StreamFormatInt16 = 2
+	StreamFormatInt24 = 3
+	StreamFormatFloat = 4
+
+	// StreamFormatCompressed sends DEFLATE compressed 8 bit FFT bins. FFT only.
+	StreamFormatCompressed = 5
+)
+
+// Message types, sent by the server
+const (
+	MsgTypeDeviceInfo  = 0
+	MsgTypeClientSync  = 1
+	MsgTypePong        = 2
+	MsgTypeReadSetting = 3
+
+	MsgTypeUint8IQ = 100
+	MsgTypeInt16IQ = 101
+	MsgTypeInt24IQ = 102
+	MsgTypeFloatIQ = 103
+
+	MsgTypeUint8AF      = 200
+	MsgTypeInt16AF      = 201
+	MsgTypeInt24AF      = 202
+	MsgTypeFloatAF      = 203
+	MsgTypeCompressedAF = 204
+
+	MsgTypeDint4FFT      = 300
+	MsgTypeUint8FFT      = 301
+	MsgTypeCompressedFFT = 302
+)
+
+// Compatible returns true if two protocol versions have the same major and minor numbers
+func Compatible(a, b uint32) bool {
+	return a>>16 == b>>16
+}
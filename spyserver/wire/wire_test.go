@@ -0,0 +1,224 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+var testInfo = DeviceInfo{
+	DeviceType:           1,
+	DeviceSerial:         0x1234,
+	MaximumSampleRate:    10000000,
+	MaximumBandwidth:     8000000,
+	DecimationStageCount: 8,
+	GainStageCount:       21,
+	MaximumGainIndex:     21,
+	MinimumFrequency:     24000000,
+	MaximumFrequency:     1800000000,
+	Resolution:           12,
+	MinimumIQDecimation:  1,
+	ForcedIQFormat:       2,
+}
+
+var testSync = ClientSync{
+	CanControl:                1,
+	Gain:                      5,
+	DeviceCenterFrequency:     100000000,
+	IQCenterFrequency:         100000000,
+	FFTCenterFrequency:        100000000,
+	MinimumIQCenterFrequency:  24000000,
+	MaximumIQCenterFrequency:  1800000000,
+	MinimumFFTCenterFrequency: 24000000,
+	MaximumFFTCenterFrequency: 1800000000,
+}
+
+func TestStructures(t *testing.T) {
+	var b = testInfo.Append(nil)
+	if len(b) != DeviceInfoSize {
+		t.Fatalf("expected %d bytes, got %d", DeviceInfoSize, len(b))
+	}
+	if info, err := DecodeDeviceInfo(b); err != nil || info != testInfo {
+		t.Fatalf("unexpected device info %+v (%v)", info, err)
+	}
+	if _, err := DecodeDeviceInfo(b[:DeviceInfoSize-1]); !errors.Is(err, ErrShortBody) {
+		t.Fatalf("expected ErrShortBody, got %v", err)
+	}
+
+	b = testSync.Append(nil)
+	if len(b) != ClientSyncSize {
+		t.Fatalf("expected %d bytes, got %d", ClientSyncSize, len(b))
+	}
+	if sync, err := DecodeClientSync(b); err != nil || sync != testSync {
+		t.Fatalf("unexpected client sync %+v (%v)", sync, err)
+	}
+
+	var h = MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypeInt16IQ, StreamType: StreamTypeIQ, SequenceNumber: 7, BodySize: 3}
+	if decoded, err := DecodeMessageHeader(AppendMessageHeader(nil, h)); err != nil || decoded != h {
+		t.Fatalf("unexpected message header %+v (%v)", decoded, err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var b []byte
+	b = AppendHello(b, ProtocolVersion, "test")
+	b = AppendSetSetting(b, SettingIqFrequency, 100000000)
+	b = AppendGetSetting(b, SettingGain)
+	b = AppendPing(b)
+
+	var d = NewDecoder(bytes.NewReader(b))
+	var expected = []struct {
+		cmd  uint32
+		body []byte
+	}{
+		{CmdHello, append(appendUint32s(nil, ProtocolVersion), "test"...)},
+		{CmdSetSetting, appendUint32s(nil, SettingIqFrequency, 100000000)},
+		{CmdGetSetting, appendUint32s(nil, SettingGain)},
+		{CmdPing, []byte{}},
+	}
+
+	for _, e := range expected {
+		h, body, err := d.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.CommandType != e.cmd || h.BodySize != uint32(len(e.body)) || !bytes.Equal(body, e.body) {
+			t.Fatalf("unexpected command %+v %v, expected %d %v", h, body, e.cmd, e.body)
+		}
+	}
+
+	if _, _, err := d.ReadCommand(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	var b []byte
+	b = AppendMessage(b, MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypeDeviceInfo}, testInfo.Append(nil))
+	b = AppendMessage(b, MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypePong}, nil)
+	b = AppendMessage(b, MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypeClientSync, SequenceNumber: 1}, testSync.Append(nil))
+
+	var d = NewDecoder(bytes.NewReader(b))
+
+	h, body, err := d.ReadMessage()
+	if err != nil || h.MessageType != MsgTypeDeviceInfo || h.BodySize != DeviceInfoSize {
+		t.Fatalf("unexpected message %+v (%v)", h, err)
+	}
+	if info, _ := DecodeDeviceInfo(body); info != testInfo {
+		t.Fatalf("unexpected device info %+v", info)
+	}
+
+	h, body, err = d.ReadMessage()
+	if err != nil || h.MessageType != MsgTypePong || len(body) != 0 {
+		t.Fatalf("unexpected message %+v %v (%v)", h, body, err)
+	}
+
+	h, body, err = d.ReadMessage()
+	if err != nil || h.MessageType != MsgTypeClientSync || h.SequenceNumber != 1 {
+		t.Fatalf("unexpected message %+v (%v)", h, err)
+	}
+	if sync, _ := DecodeClientSync(body); sync != testSync {
+		t.Fatalf("unexpected client sync %+v", sync)
+	}
+
+	if _, _, err = d.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	var message = AppendMessage(nil, MessageHeader{MessageType: MsgTypeClientSync}, testSync.Append(nil))
+
+	for _, size := range []int{3, MessageHeaderSize, MessageHeaderSize + 1} {
+		if _, _, err := NewDecoder(bytes.NewReader(message[:size])).ReadMessage(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF with %d bytes, got %v", size, err)
+		}
+	}
+
+	var tooLarge = AppendMessageHeader(nil, MessageHeader{BodySize: MaxMessageBodySize + 1})
+	if _, _, err := NewDecoder(bytes.NewReader(tooLarge)).ReadMessage(); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+
+	tooLarge = AppendCommandHeader(nil, CommandHeader{BodySize: MaxCommandBodySize + 1})
+	if _, _, err := NewDecoder(bytes.NewReader(tooLarge)).ReadCommand(); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	if !Compatible(ProtocolVersion, ProtocolVersion+1) {
+		t.Fatal("expected a different revision to be compatible")
+	}
+	if Compatible(ProtocolVersion, ProtocolVersion+1<<16) {
+		t.Fatal("expected a different minor version to be incompatible")
+	}
+}
+
+// loopReader repeats the same stream forever
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+
+func benchmarkReadMessage(b *testing.B, bodySize int) {
+	var stream = AppendMessage(nil, MessageHeader{ProtocolID: ProtocolVersion, MessageType: MsgTypeInt16IQ, StreamType: StreamTypeIQ}, make([]byte, bodySize))
+	var d = NewDecoder(bufio.NewReaderSize(&loopReader{data: stream}, 64*1024))
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(stream)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := d.ReadMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadMessageSmall(b *testing.B) {
+	benchmarkReadMessage(b, ClientSyncSize)
+}
+
+func BenchmarkReadMessageIQ(b *testing.B) {
+	benchmarkReadMessage(b, 64*1024)
+}
+
+func BenchmarkReadCommand(b *testing.B) {
+	var d = NewDecoder(bufio.NewReader(&loopReader{data: AppendSetSetting(nil, SettingIqFrequency, 100000000)}))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := d.ReadCommand(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendSetSetting(b *testing.B) {
+	var buf = make([]byte, 0, 64)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendSetSetting(buf[:0], SettingIqFrequency, uint32(i))
+	}
+}
+
+func BenchmarkDecodeClientSync(b *testing.B) {
+	var body = testSync.Append(nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeClientSync(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package spytypes
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy defines what a FrameChannel does when the consumer is slower than the source.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the consumer. It stalls the source, which may cause drops on the device or server side.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest buffered frame to make room for the new one.
+	OverflowDropOldest
+	// OverflowDropNewest discards the new frame and keeps the buffered ones.
+	OverflowDropNewest
+)
+
+// FrameChannel is a buffered channel between a source and a consumer that never lets a slow
+// consumer stall the source, unless the policy is OverflowBlock.
+// Send may be called from any goroutine. Close unblocks any pending Send and then closes the channel.
+type FrameChannel[T any] struct {
+	c       chan T
+	policy  OverflowPolicy
+	mtx     sync.Mutex
+	closed  bool
+	quit    chan struct{}
+	once    sync.Once
+	dropped atomic.Uint64
+}
+
+// NewFrameChannel creates a FrameChannel that buffers up to depth frames. The depth is at least 1.
+func NewFrameChannel[T any](depth int, policy OverflowPolicy) *FrameChannel[T] {
+	if depth < 1 {
+		depth = 1
+	}
+	return &FrameChannel[T]{
+		c:      make(chan T, depth),
+		policy: policy,
+		quit:   make(chan struct{}),
+	}
+}
+
+// C returns the channel to receive from. It is closed by Close.
+func (fc *FrameChannel[T]) C() <-chan T {
+	return fc.c
+}
+
+// Send delivers a frame following the overflow policy.
+// It returns false if the frame was dropped or the channel is closed.
+func (fc *FrameChannel[T]) Send(v T) bool {
+	fc.mtx.Lock()
+	defer fc.mtx.Unlock()
+
+	if fc.closed {
+		return false
+	}
+
+	switch fc.policy {
+	case OverflowDropNewest:
+		select {
+		case fc.c <- v:
+			return true
+		default:
+			fc.dropped.Add(1)
+			return false
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case fc.c <- v:
+				return true
+			default:
+			}
+			select {
+			case <-fc.c:
+				fc.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case fc.c <- v:
+			return true
+		case <-fc.quit:
+			return false
+		}
+	}
+}
+
+// Dropped returns the number of frames discarded by the overflow policy.
+func (fc *FrameChannel[T]) Dropped() uint64 {
+	return fc.dropped.Load()
+}
+
+// Close closes the channel. Frames already buffered can still be received. It is safe to call Close more than once.
+func (fc *FrameChannel[T]) Close() {
+	fc.once.Do(func() {
+		close(fc.quit)
+		fc.mtx.Lock()
+		fc.closed = true
+		close(fc.c)
+		fc.mtx.Unlock()
+	})
+}
@@ -0,0 +1,84 @@
+package spytypes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameChannelDropNewest(t *testing.T) {
+	var fc = NewFrameChannel[int](2, OverflowDropNewest)
+
+	for i := 0; i < 4; i++ {
+		fc.Send(i)
+	}
+	fc.Close()
+
+	var got []int
+	for v := range fc.C() {
+		got = append(got, v)
+	}
+
+	if len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Fatalf("expected [0 1], got %v", got)
+	}
+	if fc.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped frames, got %d", fc.Dropped())
+	}
+}
+
+func TestFrameChannelDropOldest(t *testing.T) {
+	var fc = NewFrameChannel[int](2, OverflowDropOldest)
+
+	for i := 0; i < 4; i++ {
+		if !fc.Send(i) {
+			t.Fatalf("expected frame %d to be delivered", i)
+		}
+	}
+	fc.Close()
+
+	var got []int
+	for v := range fc.C() {
+		got = append(got, v)
+	}
+
+	if len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("expected [2 3], got %v", got)
+	}
+	if fc.Dropped() != 2 {
+		t.Fatalf("expected 2 dropped frames, got %d", fc.Dropped())
+	}
+}
+
+func TestFrameChannelBlock(t *testing.T) {
+	var fc = NewFrameChannel[int](1, OverflowBlock)
+	fc.Send(0)
+
+	var sent = make(chan bool)
+	go func() {
+		sent <- fc.Send(1)
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("expected Send to block while the buffer is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	<-fc.C()
+	if !<-sent {
+		t.Fatal("expected the blocked frame to be delivered")
+	}
+
+	go func() {
+		sent <- fc.Send(2)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fc.Close()
+
+	if <-sent {
+		t.Fatal("expected Close to abort the blocked Send")
+	}
+	if fc.Send(3) {
+		t.Fatal("expected Send to fail after Close")
+	}
+}
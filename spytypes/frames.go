@@ -0,0 +1,85 @@
+package spytypes
+
+import "time"
+
+// SampleBlock is a block of IQ samples with the parameters it was captured with.
+// Only the slice matching the stream format is set. The slices are shared with the
+// handler functions and other channels, so they must not be modified.
+//
+// For spyserver, the center frequency and sample rate are the values confirmed by the server,
+// so blocks that were in flight during a change keep the previous values.
+type SampleBlock struct {
+	// SequenceNumber is the protocol sequence number of the message (spyserver), or the transfer count (airspy)
+	SequenceNumber uint32
+	// StreamType is the protocol stream type of the message (spyserver only)
+	StreamType uint32
+	// MessageType is the protocol message type, which defines the sample format (spyserver only)
+	MessageType uint32
+	// CenterFrequency is the center frequency of the block, in Hz
+	CenterFrequency uint32
+	// SampleRate is the sample rate of the block, in samples per second
+	SampleRate uint32
+	// DecimationStage is the decimation stage of the block (spyserver only)
+	DecimationStage uint32
+	// Timestamp is when the block was received
+	Timestamp time.Time
+	// SampleIndex is the index of the first sample of the block, counting all received samples since the connection or start
+	SampleIndex uint64
+	// Retuned is set on the first block known to be at a new center frequency or sample rate,
+	// including the first block of each connection (spyserver only)
+	Retuned bool
+
+	// Complex64 is set for Float IQ samples
+	Complex64 []complex64
+	// ComplexInt16 is set for 16 bit signed integer IQ samples
+	ComplexInt16 []ComplexInt16
+	// ComplexUInt8 is set for 8 bit unsigned integer IQ samples
+	ComplexUInt8 []ComplexUInt8
+	// ComplexInt32 is set for 24 bit signed integer IQ samples
+	ComplexInt32 []ComplexInt32
+}
+
+// FFTFrame is a set of FFT bins with the parameters it was captured with.
+// The bins are shared with the handler functions and other channels, so they must not be modified.
+type FFTFrame struct {
+	// SequenceNumber is the protocol sequence number of the message
+	SequenceNumber uint32
+	// StreamType is the protocol stream type of the message
+	StreamType uint32
+	// MessageType is the protocol message type, which defines the bins format
+	MessageType uint32
+	// CenterFrequency is the center frequency of the display, in Hz
+	CenterFrequency uint32
+	// SampleRate is the sample rate of the display, in samples per second
+	SampleRate uint32
+	// DecimationStage is the decimation stage of the display
+	DecimationStage uint32
+	// Timestamp is when the frame was received
+	Timestamp time.Time
+	// FrameIndex is the index of the frame, counting all received frames since the connection
+	FrameIndex uint64
+
+	// Bins are the 8 bit FFT bins
+	Bins []uint8
+}
+
+// AudioFrame is a block of demodulated audio samples with the parameters it was received with.
+// The samples are shared with the handler functions and other channels, so they must not be modified.
+type AudioFrame struct {
+	// SequenceNumber is the protocol sequence number of the message
+	SequenceNumber uint32
+	// MessageType is the protocol message type, which defines the original sample format
+	MessageType uint32
+	// CenterFrequency is the frequency of the demodulated channel, in Hz
+	CenterFrequency uint32
+	// SampleRate is the sample rate of the audio, in samples per second.
+	// It is 0 when the source doesn't report it. The spyserver protocol never does.
+	SampleRate uint32
+	// Timestamp is when the frame was received
+	Timestamp time.Time
+	// SampleIndex is the index of the first sample of the frame, counting all received audio samples since the connection
+	SampleIndex uint64
+
+	// Samples are the audio samples, normalized between -1 and 1
+	Samples []float32
+}
@@ -1,11 +1,20 @@
 package spytypes
 
+import "time"
+
 // ComplexInt16 is a Complex Number in a signed 16 bit number
 type ComplexInt16 struct {
 	Real int16
 	Imag int16
 }
 
+// ComplexInt32 is a Complex Number in a signed 32 bit number
+// It is used for the 24 bit signed integer samples, sign extended to 32 bit
+type ComplexInt32 struct {
+	Real int32
+	Imag int32
+}
+
 // ComplexUInt16 is a Complex Number in a unsigned 16 bit number
 type ComplexUInt16 struct {
 	Real uint16
@@ -19,62 +28,125 @@ type ComplexUInt8 struct {
 	Imag uint8
 }
 
-//
-//// Complex64SamplesCallback callback type for Float IQ Samples
-//type Complex64SamplesCallback func(data []complex64)
-//
-//// Complex32SamplesCallback callback type for 16 bit signed integer IQ Samples
-//type Complex32SamplesCallback func(data []ComplexInt16)
-//
-//// RealFloatSamplesCallback callback type for Float Real Samples
-//type RealFloatSamplesCallback func(data []float32)
-//
-//// RealFloatSamplesCallback callback type for 16 bit signed integer Real Samples
-//type RealI16SamplesCallback func(data []int16)
-//
-//// RealFloatSamplesCallback callback type for 16 bit unsigned integer Real Samples
-//type RealU16SamplesCallback func(data []uint16)
-//
-//// Complex16SamplesCallback callback type for 8 bit unsigned integer IQ Samples
-//type Complex16SamplesCallback func(data []ComplexUInt8)
-//
-//// RawCallback callback type for raw data from device
-//type RawCallback func(data []byte)
-//
-//// FFTSamplesCallback callback type for 8 bit FFT Bins Samples.
-//type FFTSamplesCallback func(data []uint8)
-//
-//// DeviceSyncCallback callback type for Device Sync Packets.
-//type DeviceSyncCallback func()
-//
-//// CallbackBase the base struct for the Airspy Data Callbacks.
-//type CallbackBase struct {
-//	// OnFloatIQ Called when a new set of Float IQ Samples are available (currently not in use)
-//	OnFloatIQ Complex64SamplesCallback
-//	// OnInt16IQ Called when a new set of 16 bit signed integer IQ Samples are available (default)
-//	OnInt16IQ Complex32SamplesCallback
-//	// OnInt16IQ Called when a new set of 16 bit signed integer Real Samples are available (default)
-//	OnInt16Real RealI16SamplesCallback
-//	// OnInt16IQ Called when a new set of 16 bit unsigned integer Real Samples are available (default)
-//	OnUInt16Real RealU16SamplesCallback
-//	// OnRaw Called when a new set of raw data from the device are available
-//	OnRaw RawCallback
-//}
-//
-//// SpyserverCallbackBase the base struct for the Spyserver Data Callbacks.
-//// Currently the only IQ Mode enabled is Int16IQ so OnFloatIQ and OnUInt8IQ can be nil safely.
-//type SpyserverCallbackBase struct {
-//	// OnFloatIQ Called when a new set of Float IQ Samples are available (currently not in use)
-//	OnFloatIQ Complex64SamplesCallback
-//	// OnInt16IQ Called when a new set of 16 bit signed integer IQ Samples are available (default)
-//	OnInt16IQ Complex32SamplesCallback
-//	// OnUInt8IQ Called when a new set of 8 bit unsigned integer IQ Samples are available (currently not in use)
-//	OnUInt8IQ Complex16SamplesCallback
-//	// OnFFT Called when a new set of 8 bit FFT bins are available
-//	OnFFT FFTSamplesCallback
-//	// OnDeviceSync Called when a Device Sync Packet is received. Any changes from the server will be notified here.
-//	OnDeviceSync DeviceSyncCallback
-//}
+// Complex64SamplesCallback callback type for Float IQ Samples
+type Complex64SamplesCallback func(data []complex64)
+
+// Complex32SamplesCallback callback type for 16 bit signed integer IQ Samples
+type Complex32SamplesCallback func(data []ComplexInt16)
+
+// ComplexInt24SamplesCallback callback type for 24 bit signed integer IQ Samples
+type ComplexInt24SamplesCallback func(data []ComplexInt32)
+
+// RealFloatSamplesCallback callback type for Float Real Samples
+type RealFloatSamplesCallback func(data []float32)
+
+// RealI16SamplesCallback callback type for 16 bit signed integer Real Samples
+type RealI16SamplesCallback func(data []int16)
+
+// RealU16SamplesCallback callback type for 16 bit unsigned integer Real Samples
+type RealU16SamplesCallback func(data []uint16)
+
+// Complex16SamplesCallback callback type for 8 bit unsigned integer IQ Samples
+type Complex16SamplesCallback func(data []ComplexUInt8)
+
+// RawCallback callback type for raw data from device
+type RawCallback func(data []byte)
+
+// FFTSamplesCallback callback type for 8 bit FFT Bins Samples.
+type FFTSamplesCallback func(data []uint8)
+
+// DeviceSyncCallback callback type for Device Sync Packets.
+type DeviceSyncCallback func()
+
+// DeviceSyncEventCallback callback type for Device Sync Packets with the old and new values.
+type DeviceSyncEventCallback func(event DeviceSyncEvent)
+
+// ControlCallback callback type for changes of the device control.
+type ControlCallback func()
+
+// SampleBlockCallback callback type for IQ Samples with their metadata.
+type SampleBlockCallback func(block SampleBlock)
+
+// FFTFrameCallback callback type for FFT Bins with their metadata.
+type FFTFrameCallback func(frame FFTFrame)
+
+// AudioFrameCallback callback type for demodulated audio.
+type AudioFrameCallback func(frame AudioFrame)
+
+// ErrorCallback callback type for errors that stopped the source.
+type ErrorCallback func(err error)
+
+// ReconnectCallback callback type for reconnect events.
+type ReconnectCallback func(info ReconnectInfo)
+
+// Handler is the typed replacement for Callback. Every field is optional:
+// data without a handler function is not decoded at all.
+// Both spyserver.Spyserver and airspy.Device accept it through SetHandler.
+type Handler struct {
+	// OnFloatIQ Called when a new set of Float IQ Samples are available
+	OnFloatIQ Complex64SamplesCallback
+	// OnInt16IQ Called when a new set of 16 bit signed integer IQ Samples are available (spyserver default)
+	OnInt16IQ Complex32SamplesCallback
+	// OnUInt8IQ Called when a new set of 8 bit unsigned integer IQ Samples are available
+	OnUInt8IQ Complex16SamplesCallback
+	// OnInt24IQ Called when a new set of 24 bit signed integer IQ Samples are available (spyserver only)
+	OnInt24IQ ComplexInt24SamplesCallback
+	// OnFloatReal Called when a new set of Float Real Samples are available (airspy only)
+	OnFloatReal RealFloatSamplesCallback
+	// OnInt16Real Called when a new set of 16 bit signed integer Real Samples are available (airspy only)
+	OnInt16Real RealI16SamplesCallback
+	// OnUInt16Real Called when a new set of 16 bit unsigned integer Real Samples are available (airspy only)
+	OnUInt16Real RealU16SamplesCallback
+	// OnRaw Called when a new set of raw data from the device are available (airspy only)
+	OnRaw RawCallback
+	// OnFFT Called when a new set of 8 bit FFT bins are available (spyserver only)
+	OnFFT FFTSamplesCallback
+	// OnSampleBlock Called with every IQ block and its metadata, in addition to the matching OnXXXIQ
+	OnSampleBlock SampleBlockCallback
+	// OnFFTFrame Called with every FFT frame and its metadata, in addition to OnFFT (spyserver only)
+	OnFFTFrame FFTFrameCallback
+	// OnAudio Called when a new set of demodulated audio samples are available (spyserver only)
+	OnAudio AudioFrameCallback
+	// OnDeviceSync Called when a Device Sync Packet is received. Any changes from the server will be notified here.
+	OnDeviceSync DeviceSyncCallback
+	// OnSyncEvent Called with the old and new values when a Device Sync Packet is received (spyserver only)
+	OnSyncEvent DeviceSyncEventCallback
+	// OnControlLost Called when another client takes the control of the device (spyserver only)
+	OnControlLost ControlCallback
+	// OnControlRegained Called when this client can control the device again (spyserver only)
+	OnControlRegained ControlCallback
+	// OnError Called when the source stops because of a failure
+	OnError ErrorCallback
+	// OnReconnecting Called before each reconnect attempt
+	OnReconnecting ReconnectCallback
+	// OnReconnected Called when the connection is back and all settings were replayed
+	OnReconnected ReconnectCallback
+}
+
+// CallbackHandler adapts a legacy Callback to a Handler.
+// Each event is forwarded to OnData with the matching data type constant.
+func CallbackHandler(cb Callback) Handler {
+	if cb == nil {
+		return Handler{}
+	}
+
+	return Handler{
+		OnFloatIQ:      func(data []complex64) { cb.OnData(SamplesComplex64, data) },
+		OnInt16IQ:      func(data []ComplexInt16) { cb.OnData(SamplesComplex32, data) },
+		OnUInt8IQ:      func(data []ComplexUInt8) { cb.OnData(SamplesComplexUInt8, data) },
+		OnInt24IQ:      func(data []ComplexInt32) { cb.OnData(SamplesComplexInt24, data) },
+		OnFloatReal:    func(data []float32) { cb.OnData(SamplesFloat32, data) },
+		OnInt16Real:    func(data []int16) { cb.OnData(SamplesInt16, data) },
+		OnUInt16Real:   func(data []uint16) { cb.OnData(SamplesUInt16, data) },
+		OnRaw:          func(data []byte) { cb.OnData(SamplesBytes, data) },
+		OnFFT:          func(data []uint8) { cb.OnData(FFTUInt8, data) },
+		OnAudio:        func(frame AudioFrame) { cb.OnData(SamplesAudio, frame) },
+		OnSyncEvent:    func(event DeviceSyncEvent) { cb.OnData(DeviceSync, event) },
+		OnError:        func(err error) { cb.OnData(Error, err) },
+		OnReconnecting: func(info ReconnectInfo) { cb.OnData(Reconnecting, info) },
+		OnReconnected:  func(info ReconnectInfo) { cb.OnData(Reconnected, info) },
+	}
+}
 
 const (
 	SamplesComplex64 = iota
@@ -85,9 +157,34 @@ const (
 	SamplesComplexUInt8
 	SamplesBytes
 	FFTUInt8
+	// DeviceSync is delivered with a DeviceSyncEvent when a Device Sync Packet is received.
 	DeviceSync
+	// Error is delivered with an error value when the source stops because of a failure.
+	Error
+	// Reconnecting is delivered with a ReconnectInfo before each reconnect attempt.
+	Reconnecting
+	// Reconnected is delivered with a ReconnectInfo when the connection is back and all settings were replayed.
+	Reconnected
+	// SamplesComplexInt24 is delivered with a []ComplexInt32 holding 24 bit signed integer IQ samples.
+	SamplesComplexInt24
+	// SamplesAudio is delivered with an AudioFrame holding demodulated audio.
+	SamplesAudio
 )
 
+// ReconnectInfo is the data of the Reconnecting and Reconnected events.
+type ReconnectInfo struct {
+	// Attempt is the number of the current reconnect attempt, starting at 1
+	Attempt int
+	// Err is the error that closed the connection or that failed the previous attempt
+	Err error
+	// LostAt is when the connection was lost. Data between LostAt and the Reconnected event is missing.
+	LostAt time.Time
+}
+
+// Callback is the legacy untyped callback. The data type is one of the Samples*, FFTUInt8, DeviceSync,
+// Error, Reconnecting or Reconnected constants.
+//
+// Deprecated: use Handler, or CallbackHandler to adapt an existing Callback.
 type Callback interface {
 	OnData(int, interface{})
 }
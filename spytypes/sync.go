@@ -0,0 +1,67 @@
+package spytypes
+
+// DeviceSyncState is the device state reported by a Device Sync Packet.
+type DeviceSyncState struct {
+	// CanControl is true if this client can change the device settings
+	CanControl bool
+	// Gain is the gain index
+	Gain uint32
+	// DeviceCenterFrequency is the frequency the device is tuned to, in Hz
+	DeviceCenterFrequency uint32
+	// IQCenterFrequency is the center frequency of the IQ channel, in Hz
+	IQCenterFrequency uint32
+	// FFTCenterFrequency is the center frequency of the FFT, in Hz
+	FFTCenterFrequency uint32
+	// MinimumIQCenterFrequency is the lowest center frequency allowed for the IQ channel, in Hz
+	MinimumIQCenterFrequency uint32
+	// MaximumIQCenterFrequency is the highest center frequency allowed for the IQ channel, in Hz
+	MaximumIQCenterFrequency uint32
+	// MinimumFFTCenterFrequency is the lowest center frequency allowed for the FFT, in Hz
+	MinimumFFTCenterFrequency uint32
+	// MaximumFFTCenterFrequency is the highest center frequency allowed for the FFT, in Hz
+	MaximumFFTCenterFrequency uint32
+}
+
+// DeviceSyncEvent is delivered with every Device Sync Packet.
+// Old is the state before the packet, which is the zero value for the first packet of a connection.
+type DeviceSyncEvent struct {
+	Old DeviceSyncState
+	New DeviceSyncState
+	// First is true for the first packet of a connection
+	First bool
+}
+
+// Changed returns true if any value differs from the previous packet
+func (e DeviceSyncEvent) Changed() bool {
+	return e.Old != e.New
+}
+
+// GainChanged returns true if the gain differs from the previous packet
+func (e DeviceSyncEvent) GainChanged() bool {
+	return e.Old.Gain != e.New.Gain
+}
+
+// FrequencyChanged returns true if the device, IQ or FFT center frequency differs from the previous packet
+func (e DeviceSyncEvent) FrequencyChanged() bool {
+	return e.Old.DeviceCenterFrequency != e.New.DeviceCenterFrequency ||
+		e.Old.IQCenterFrequency != e.New.IQCenterFrequency ||
+		e.Old.FFTCenterFrequency != e.New.FFTCenterFrequency
+}
+
+// RangeChanged returns true if any of the tunable ranges differs from the previous packet
+func (e DeviceSyncEvent) RangeChanged() bool {
+	return e.Old.MinimumIQCenterFrequency != e.New.MinimumIQCenterFrequency ||
+		e.Old.MaximumIQCenterFrequency != e.New.MaximumIQCenterFrequency ||
+		e.Old.MinimumFFTCenterFrequency != e.New.MinimumFFTCenterFrequency ||
+		e.Old.MaximumFFTCenterFrequency != e.New.MaximumFFTCenterFrequency
+}
+
+// ControlLost returns true if this client could control the device and now it can't
+func (e DeviceSyncEvent) ControlLost() bool {
+	return !e.First && e.Old.CanControl && !e.New.CanControl
+}
+
+// ControlRegained returns true if this client couldn't control the device and now it can
+func (e DeviceSyncEvent) ControlRegained() bool {
+	return !e.First && !e.Old.CanControl && e.New.CanControl
+}